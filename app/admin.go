@@ -5,15 +5,17 @@ import (
 	"encoding/json"
 	"github.com/bmizerany/pat"
 	"github.com/ngerakines/tram/config"
+	"github.com/ngerakines/tram/util"
 	"github.com/rcrowley/go-metrics"
 	"net/http"
 	"strconv"
 )
 
 type adminBlueprint struct {
-	base      string
-	registry  metrics.Registry
-	appConfig *config.AppConfig
+	base         string
+	registry     metrics.Registry
+	appConfig    *config.AppConfig
+	rateLimiters *util.RateLimiters
 }
 
 type errorViewError struct {
@@ -26,11 +28,12 @@ type errorsView struct {
 }
 
 // NewAdminBlueprint creates a new adminBlueprint object.
-func newAdminBlueprint(registry metrics.Registry, appConfig *config.AppConfig) *adminBlueprint {
+func newAdminBlueprint(registry metrics.Registry, appConfig *config.AppConfig, rateLimiters *util.RateLimiters) *adminBlueprint {
 	blueprint := new(adminBlueprint)
 	blueprint.base = "/admin"
 	blueprint.registry = registry
 	blueprint.appConfig = appConfig
+	blueprint.rateLimiters = rateLimiters
 	return blueprint
 }
 
@@ -38,10 +41,11 @@ func (blueprint *adminBlueprint) AddRoutes(p *pat.PatternServeMux) {
 	p.Get(blueprint.base+"/config", http.HandlerFunc(blueprint.configHandler))
 	p.Get(blueprint.base+"/errors", http.HandlerFunc(blueprint.errorsHandler))
 	p.Get(blueprint.base+"/metrics", http.HandlerFunc(blueprint.metricsHandler))
+	p.Get(blueprint.base+"/limiters", http.HandlerFunc(blueprint.limitersHandler))
 }
 
 func (blueprint *adminBlueprint) configHandler(res http.ResponseWriter, req *http.Request) {
-	content := blueprint.appConfig.Source
+	content := blueprint.appConfig.Redacted()
 	res.Header().Set("Content-Length", strconv.Itoa(len(content)))
 	res.Write([]byte(content))
 }
@@ -54,6 +58,14 @@ func (blueprint *adminBlueprint) metricsHandler(res http.ResponseWriter, req *ht
 	res.Write(content.Bytes())
 }
 
+func (blueprint *adminBlueprint) limitersHandler(res http.ResponseWriter, req *http.Request) {
+	content := &bytes.Buffer{}
+	enc := json.NewEncoder(content)
+	enc.Encode(blueprint.rateLimiters.State())
+	res.Header().Set("Content-Length", strconv.Itoa(content.Len()))
+	res.Write(content.Bytes())
+}
+
 func (blueprint *adminBlueprint) errorsHandler(res http.ResponseWriter, req *http.Request) {
 	view := new(errorsView)
 	view.Errors = make([]errorViewError, 0, 0)
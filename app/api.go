@@ -1,38 +1,171 @@
 package app
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
 	"github.com/bmizerany/pat"
+	"github.com/ngerakines/codederror"
+	"github.com/ngerakines/tram/config"
+	"github.com/ngerakines/tram/util"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type apiBlueprint struct {
 	base           string
 	fileCache      FileCache
+	index          Index
 	storageManager StorageManager
+	storageEngine  string
+	allow          []string
+	deny           []string
+	aliasPattern   *regexp.Regexp
+	tokens         []string
 }
 
-func newApiBlueprint(fileCache FileCache, storageManager StorageManager) Blueprint {
+type warmRequest struct {
+	Url     string   `json:"url"`
+	Aliases []string `json:"aliases"`
+	Digest  string   `json:"digest"`
+}
+
+type warmView struct {
+	Url         string           `json:"url"`
+	Aliases     []string         `json:"aliases"`
+	Digest      string           `json:"digest,omitempty"`
+	Status      string           `json:"status"`
+	ContentHash string           `json:"contentHash,omitempty"`
+	Location    string           `json:"location,omitempty"`
+	Errors      []errorViewError `json:"errors,omitempty"`
+}
+
+type downloadErrorView struct {
+	Errors         []errorViewError `json:"errors"`
+	Url            string           `json:"url"`
+	UpstreamStatus int              `json:"upstreamStatus,omitempty"`
+}
+
+type purgeView struct {
+	ContentHash string   `json:"contentHash"`
+	Urls        []string `json:"urls"`
+	Aliases     []string `json:"aliases"`
+}
+
+type metaView struct {
+	ContentHash   string            `json:"contentHash"`
+	HashAlgorithm string            `json:"hashAlgorithm"`
+	Size          int               `json:"size"`
+	Urls          []string          `json:"urls"`
+	Aliases       []string          `json:"aliases"`
+	Attributes    map[string]string `json:"attributes"`
+	StorageEngine string            `json:"storageEngine"`
+	Fetched       string            `json:"fetched,omitempty"`
+	LruPosition   *int              `json:"lruPosition"`
+}
+
+type entriesView struct {
+	Total   int         `json:"total"`
+	Offset  int         `json:"offset"`
+	Limit   int         `json:"limit"`
+	Entries []*metaView `json:"entries"`
+}
+
+type batchWarmRequest struct {
+	Entries []warmRequest `json:"entries"`
+}
+
+type batchWarmView struct {
+	Entries []*warmView `json:"entries"`
+}
+
+const (
+	maxBatchSize        = 1000
+	defaultEntriesLimit = 100
+	maxEntriesLimit     = 1000
+	defaultAliasPattern = "^[A-Za-z0-9]([A-Za-z0-9._/+-]|:[A-Za-z0-9._+-]){0,255}:?$"
+	aliasesHeader       = "X-Tram-Aliases"
+)
+
+// contentHashPattern matches the hex encoded content hashes of each of the
+// supported hash algorithms.
+var contentHashPattern = regexp.MustCompile("^([0-9a-f]{40}|[0-9a-f]{64}|[0-9a-f]{128})$")
+
+func newApiBlueprint(appConfig *config.AppConfig, fileCache FileCache, index Index, storageManager StorageManager) (Blueprint, error) {
+	aliasPattern := appConfig.Api.AliasPattern
+	if aliasPattern == "" {
+		aliasPattern = defaultAliasPattern
+	}
+	compiledAliasPattern, err := regexp.Compile(aliasPattern)
+	if err != nil {
+		return nil, err
+	}
+
 	blueprint := new(apiBlueprint)
 	blueprint.base = "/"
 	blueprint.fileCache = fileCache
+	blueprint.index = index
 	blueprint.storageManager = storageManager
-	return blueprint
+	blueprint.storageEngine = appConfig.Storage.Engine
+	blueprint.allow = appConfig.Fetch.Allow
+	blueprint.deny = appConfig.Fetch.Deny
+	blueprint.aliasPattern = compiledAliasPattern
+	blueprint.tokens = appConfig.Api.Tokens
+	return blueprint, nil
 }
 
 func (blueprint *apiBlueprint) AddRoutes(p *pat.PatternServeMux) {
+	p.Head(blueprint.base+"content/:hash", http.HandlerFunc(blueprint.handleContentHead))
+	p.Get(blueprint.base+"content/:hash", http.HandlerFunc(blueprint.handleContent))
+	p.Get(blueprint.base+"meta", http.HandlerFunc(blueprint.handleMeta))
+	p.Get(blueprint.base+"entries", http.HandlerFunc(blueprint.handleEntries))
+	p.Head(blueprint.base, http.HandlerFunc(blueprint.handleHead))
 	p.Get(blueprint.base, http.HandlerFunc(blueprint.handleGet))
+	p.Post(blueprint.base, http.HandlerFunc(blueprint.handlePost))
+	p.Post(blueprint.base+"batch", http.HandlerFunc(blueprint.handleBatch))
+	p.Del(blueprint.base, http.HandlerFunc(blueprint.handleDelete))
 }
 
 func (blueprint *apiBlueprint) handleGet(res http.ResponseWriter, req *http.Request) {
 	values := blueprint.getValues(req, []string{"url", "alias"})
 	url, err := blueprint.collectUrl(values)
 	aliases := blueprint.collectAliases(values)
+	if !blueprint.validAliases(aliases) {
+		writeJson(res, 400, newErrorsView(ErrorInvalidAlias))
+		return
+	}
+	digest, digestErr := parseOptionalDigest(req.URL.Query().Get("digest"))
+	if digestErr != nil {
+		writeJson(res, 400, newErrorsView(ErrorInvalidDigest))
+		return
+	}
 	if err == nil {
-		cachedFile := blueprint.fileCache.WarmAndQuery(url, aliases)
+		if !isValidUrl(url) {
+			writeJson(res, 400, newErrorsView(ErrorInvalidUrl))
+			return
+		}
+		cachedFile, err := blueprint.fileCache.WarmAndQuery(url, aliases, digest)
+		if err != nil {
+			log.Println(err)
+			blueprint.writeDownloadError(res, url, err)
+			return
+		}
 		if cachedFile != nil {
-			blueprint.storageManager.Serve(cachedFile, res, req)
+			blueprint.serve(res, req, cachedFile)
+			return
+		}
+	} else if len(aliases) > 0 {
+		// Without a url there is nothing to download, so aliases are
+		// only ever resolved against content that has already been cached.
+		cachedFile := blueprint.fileCache.Query(aliases)
+		if cachedFile != nil {
+			blueprint.serve(res, req, cachedFile)
 			return
 		}
 	}
@@ -42,14 +175,484 @@ func (blueprint *apiBlueprint) handleGet(res http.ResponseWriter, req *http.Requ
 	return
 }
 
+// serve serves the cached file along with the aliases attached to it.
+func (blueprint *apiBlueprint) serve(res http.ResponseWriter, req *http.Request, cachedFile CachedFile) {
+	if len(cachedFile.Aliases()) > 0 {
+		res.Header().Set(aliasesHeader, strings.Join(cachedFile.Aliases(), ","))
+	}
+	blueprint.storageManager.Serve(cachedFile, res, req)
+}
+
+// handleHead reports whether content for the url or aliases has been cached.
+// Unlike handleGet, content is never downloaded and the lru is not changed.
+func (blueprint *apiBlueprint) handleHead(res http.ResponseWriter, req *http.Request) {
+	values := blueprint.getValues(req, []string{"url", "alias"})
+	aliases := blueprint.collectAliases(values)
+	if !blueprint.validAliases(aliases) {
+		res.Header().Set("Content-Length", "0")
+		res.WriteHeader(400)
+		return
+	}
+
+	// Like handleGet, only the url is looked up when one is given, and
+	// aliases are only looked up by themselves.
+	var contentHash string
+	err := errors.New("Missing url or alias.")
+	if url, urlErr := blueprint.collectUrl(values); urlErr == nil {
+		contentHash, err = blueprint.index.FindUrl(url)
+	} else if len(aliases) > 0 {
+		contentHash, err = blueprint.index.FindAlias(aliases)
+	}
+	if err == nil {
+		cachedFile := blueprint.fileCache.Peek(contentHash)
+		if cachedFile != nil {
+			blueprint.writeProbe(res, cachedFile)
+			return
+		}
+	}
+	res.Header().Set("Content-Length", "0")
+	res.WriteHeader(404)
+}
+
+// handleContentHead reports whether content for the content hash has been
+// cached without serving it.
+func (blueprint *apiBlueprint) handleContentHead(res http.ResponseWriter, req *http.Request) {
+	contentHash := req.URL.Query().Get(":hash")
+	if contentHashPattern.MatchString(contentHash) {
+		cachedFile := blueprint.fileCache.Peek(contentHash)
+		if cachedFile != nil {
+			blueprint.writeProbe(res, cachedFile)
+			return
+		}
+	}
+	res.Header().Set("Content-Length", "0")
+	res.WriteHeader(404)
+}
+
+// handleContent serves content by its content hash. Content is never
+// downloaded by this handler.
+func (blueprint *apiBlueprint) handleContent(res http.ResponseWriter, req *http.Request) {
+	contentHash := req.URL.Query().Get(":hash")
+	if contentHashPattern.MatchString(contentHash) {
+		cachedFile := blueprint.fileCache.Get(contentHash)
+		if cachedFile != nil {
+			blueprint.storageManager.Serve(cachedFile, res, req)
+			return
+		}
+	}
+	res.Header().Set("Content-Length", "0")
+	res.WriteHeader(404)
+}
+
+// handleMeta returns the indexed record of content, found by url, alias or
+// content hash, without serving the content itself.
+func (blueprint *apiBlueprint) handleMeta(res http.ResponseWriter, req *http.Request) {
+	contentHash, status, codedError := blueprint.lookupContentHash(req.URL.Query())
+	if codedError != nil {
+		writeJson(res, status, newErrorsView(codedError))
+		return
+	}
+	cachedFile, err := blueprint.index.Get(contentHash)
+	if err != nil {
+		writeJson(res, 404, newErrorsView(ErrorContentNotFound))
+		return
+	}
+
+	positions := blueprint.fileCache.LruPositions([]string{contentHash})
+	writeJson(res, 200, blueprint.newMetaView(cachedFile, positions))
+}
+
+// handleEntries returns a page of the indexed records of cached content that
+// match the filters in the query string.
+func (blueprint *apiBlueprint) handleEntries(res http.ResponseWriter, req *http.Request) {
+	query, err := blueprint.parseIndexQuery(req.URL.Query())
+	if err != nil {
+		log.Println(err)
+		writeJson(res, 400, newErrorsView(ErrorInvalidQuery))
+		return
+	}
+
+	cachedFiles, total, err := blueprint.index.List(*query)
+	if err != nil {
+		log.Println(err)
+		writeJson(res, 500, newErrorsView(ErrorIndexUnavailable))
+		return
+	}
+
+	view := new(entriesView)
+	view.Total = total
+	view.Offset = query.Offset
+	view.Limit = query.Limit
+	contentHashes := make([]string, 0, len(cachedFiles))
+	for _, cachedFile := range cachedFiles {
+		contentHashes = append(contentHashes, cachedFile.ContentHash())
+	}
+	positions := blueprint.fileCache.LruPositions(contentHashes)
+	view.Entries = make([]*metaView, 0, len(cachedFiles))
+	for _, cachedFile := range cachedFiles {
+		view.Entries = append(view.Entries, blueprint.newMetaView(cachedFile, positions))
+	}
+	writeJson(res, 200, view)
+}
+
+// handleDelete removes content, found by url, alias or content hash, from the
+// cache and reports the urls and aliases that were detached from it. Requests
+// must include one of the configured api tokens as a bearer token.
+func (blueprint *apiBlueprint) handleDelete(res http.ResponseWriter, req *http.Request) {
+	if !blueprint.authorized(req) {
+		res.Header().Set("WWW-Authenticate", "Bearer")
+		writeJson(res, 401, newErrorsView(ErrorUnauthorized))
+		return
+	}
+
+	contentHash, status, codedError := blueprint.lookupContentHash(req.URL.Query())
+	if codedError != nil {
+		writeJson(res, status, newErrorsView(codedError))
+		return
+	}
+	cachedFile := blueprint.fileCache.Get(contentHash)
+	if cachedFile == nil {
+		writeJson(res, 404, newErrorsView(ErrorContentNotFound))
+		return
+	}
+
+	purgedFile, err := blueprint.fileCache.Purge(cachedFile)
+	if err != nil {
+		log.Println(err)
+		writeJson(res, 500, newErrorsView(ErrorPurgeFailed))
+		return
+	}
+
+	view := new(purgeView)
+	view.ContentHash = purgedFile.ContentHash()
+	view.Urls = purgedFile.Urls()
+	view.Aliases = purgedFile.Aliases()
+	writeJson(res, 200, view)
+}
+
+// handlePost queues the url in the request to be downloaded and returns
+// without waiting for the download to complete. The response includes the
+// location that the content can be fetched from once it has been cached.
+func (blueprint *apiBlueprint) handlePost(res http.ResponseWriter, req *http.Request) {
+	warmRequest, err := blueprint.parseWarmRequest(req)
+	if err != nil {
+		log.Println(err)
+		writeJson(res, 400, newErrorsView(ErrorInvalidRequest))
+		return
+	}
+
+	view, status := blueprint.warm(warmRequest)
+	if view.Status == "cached" || view.Status == "queued" {
+		blueprint.setWarmHeaders(res, view)
+	}
+	writeJson(res, status, view)
+}
+
+// handleBatch queues each of the entries in the request to be downloaded
+// and returns the status of each entry in the order they were given.
+func (blueprint *apiBlueprint) handleBatch(res http.ResponseWriter, req *http.Request) {
+	batchRequest := new(batchWarmRequest)
+	err := json.NewDecoder(req.Body).Decode(batchRequest)
+	if err != nil {
+		log.Println(err)
+		writeJson(res, 400, newErrorsView(ErrorInvalidRequest))
+		return
+	}
+	if len(batchRequest.Entries) > maxBatchSize {
+		writeJson(res, 400, newErrorsView(ErrorBatchTooLarge))
+		return
+	}
+
+	view := new(batchWarmView)
+	view.Entries = make([]*warmView, 0, len(batchRequest.Entries))
+	for _, entry := range batchRequest.Entries {
+		entry.Aliases = splitAliases(entry.Aliases)
+		entryView, _ := blueprint.warm(&entry)
+		view.Entries = append(view.Entries, entryView)
+	}
+	writeJson(res, 200, view)
+}
+
+// warm validates and queues a single warm request, returning a view that
+// describes whether the content is already cached, queued, rejected because
+// the download queue is full or has failed. The response status of the view
+// is also returned: requests that are not valid are a 400 and errors from the
+// file cache have the same status as they would for a GET request.
+func (blueprint *apiBlueprint) warm(warmRequest *warmRequest) (*warmView, int) {
+	view := new(warmView)
+	view.Url = warmRequest.Url
+	view.Aliases = warmRequest.Aliases
+	view.Digest = warmRequest.Digest
+
+	if warmRequest.Url == "" {
+		view.Status = "failed"
+		view.Errors = newErrorsView(ErrorMissingUrl).Errors
+		return view, 400
+	}
+	if !isValidUrl(warmRequest.Url) {
+		view.Status = "failed"
+		view.Errors = newErrorsView(ErrorInvalidUrl).Errors
+		return view, 400
+	}
+	if util.CheckUrl(warmRequest.Url, blueprint.allow, blueprint.deny) != nil {
+		view.Status = "failed"
+		view.Errors = newErrorsView(ErrorOriginNotAllowed).Errors
+		return view, 403
+	}
+	if !blueprint.validAliases(warmRequest.Aliases) {
+		view.Status = "failed"
+		view.Errors = newErrorsView(ErrorInvalidAlias).Errors
+		return view, 400
+	}
+
+	digest, err := parseOptionalDigest(warmRequest.Digest)
+	if err != nil {
+		view.Status = "failed"
+		view.Errors = newErrorsView(ErrorInvalidDigest).Errors
+		return view, 400
+	}
+
+	view.Location = blueprint.base + "?url=" + url.QueryEscape(warmRequest.Url)
+	if digest != nil {
+		view.Digest = digest.String()
+		view.Location += "&digest=" + url.QueryEscape(view.Digest)
+	}
+	view.Status = "queued"
+	cachedFile, err := blueprint.fileCache.Warm(warmRequest.Url, warmRequest.Aliases, digest)
+	if err != nil {
+		status, codedError := downloadErrorStatus(err)
+		view.Status = "failed"
+		if isCodedError(err, ErrorQueueFull) {
+			view.Status = "rejected"
+		}
+		view.Errors = newErrorsView(codedError).Errors
+		return view, status
+	}
+	if cachedFile != nil {
+		view.Status = "cached"
+		view.ContentHash = cachedFile.ContentHash()
+		return view, 200
+	}
+	return view, 202
+}
+
+func (blueprint *apiBlueprint) setWarmHeaders(res http.ResponseWriter, view *warmView) {
+	res.Header().Set("Location", view.Location)
+	if len(view.Aliases) > 0 {
+		res.Header().Set(aliasesHeader, strings.Join(view.Aliases, ","))
+	}
+}
+
+// collectAliases returns the aliases given in the request. Aliases can be
+// given with repeated alias parameters, as a comma separated list or both.
 func (blueprint *apiBlueprint) collectAliases(args map[string][]string) []string {
-	values, hasValues := args["aliases"]
+	values, hasValues := args["alias"]
 	if hasValues && values != nil && len(values) > 0 {
-		return values
+		return splitAliases(values)
 	}
 	return []string{}
 }
 
+// writeDownloadError writes a JSON response describing why the url could not
+// be downloaded, with the status given by downloadErrorStatus.
+func (blueprint *apiBlueprint) writeDownloadError(res http.ResponseWriter, url string, err error) {
+	view := new(downloadErrorView)
+	view.Url = url
+	if fetchError, ok := err.(*util.FetchError); ok {
+		view.UpstreamStatus = fetchError.StatusCode
+	}
+	status, codedError := downloadErrorStatus(err)
+	view.Errors = newErrorsView(codedError).Errors
+	writeJson(res, status, view)
+}
+
+// downloadErrorStatus returns the response status and coded error for an
+// error returned by the file cache. Failures of the origin are returned as a
+// 502, or a 504 when the origin or download did not complete in time.
+// Failures to store the content are returned as a 500, aliases that refer to
+// other content and digests that cannot be verified as a 409 and a full
+// download queue as a 503.
+func downloadErrorStatus(err error) (int, codederror.CodedError) {
+	status := 502
+	codedError := ErrorUpstreamUnavailable
+
+	if fetchError, ok := err.(*util.FetchError); ok {
+		if _, blocked := fetchError.Err.(*util.BlockedError); blocked {
+			status = 403
+			codedError = ErrorOriginNotAllowed
+		} else if fetchError.Timeout() {
+			status = 504
+			codedError = ErrorUpstreamTimeout
+		} else if fetchError.StatusCode != 0 {
+			codedError = ErrorUpstreamStatus
+		}
+	} else if isCodedError(err, ErrorDownloadTimeout) {
+		status = 504
+		codedError = ErrorDownloadTimeout
+	} else if isCodedError(err, ErrorStorageFailed) {
+		status = 500
+		codedError = ErrorStorageFailed
+	} else if isCodedError(err, ErrorQueueFull) {
+		status = 503
+		codedError = ErrorQueueFull
+	} else if isCodedError(err, ErrorAliasConflict) {
+		status = 409
+		codedError = ErrorAliasConflict
+	} else if isCodedError(err, ErrorDigestUnavailable) {
+		status = 409
+		codedError = ErrorDigestUnavailable
+	} else if otherError, ok := err.(codederror.CodedError); ok {
+		codedError = otherError
+	}
+	return status, codedError
+}
+
+// lookupContentHash returns the content hash of the content given by exactly
+// one hash, url or alias query string parameter. Requests that give more than
+// one of them could refer to different content, so they are rejected with a
+// 400 rather than guessing which was meant.
+func (blueprint *apiBlueprint) lookupContentHash(values url.Values) (string, int, codederror.CodedError) {
+	hashes := values["hash"]
+	urls := values["url"]
+	aliases := splitAliases(values["alias"])
+	switch {
+	case len(hashes)+len(urls)+len(aliases) > 1:
+		return "", 400, ErrorAmbiguousQuery
+	case len(hashes) == 1:
+		if contentHashPattern.MatchString(hashes[0]) {
+			return hashes[0], 200, nil
+		}
+	case len(urls) == 1:
+		contentHash, err := blueprint.index.FindUrl(urls[0])
+		if err == nil {
+			return contentHash, 200, nil
+		}
+	case len(aliases) == 1:
+		contentHash, err := blueprint.index.FindAlias(aliases)
+		if err == nil {
+			return contentHash, 200, nil
+		}
+	}
+	return "", 404, ErrorContentNotFound
+}
+
+// writeProbe writes the headers that describe the cached file without writing
+// the content itself.
+func (blueprint *apiBlueprint) writeProbe(res http.ResponseWriter, cachedFile CachedFile) {
+	res.Header().Set("Content-Length", strconv.Itoa(cachedFile.Size()))
+	res.Header().Set("Content-Type", "application/octet-stream")
+	setCachedFileHeaders(cachedFile, res.Header())
+	if len(cachedFile.Aliases()) > 0 {
+		res.Header().Set(aliasesHeader, strings.Join(cachedFile.Aliases(), ","))
+	}
+	res.WriteHeader(200)
+}
+
+// newMetaView returns the view of the cached file, with its position taken
+// from the lru positions.
+func (blueprint *apiBlueprint) newMetaView(cachedFile CachedFile, positions map[string]int) *metaView {
+	view := new(metaView)
+	view.ContentHash = cachedFile.ContentHash()
+	view.HashAlgorithm = cachedFile.HashAlgorithm()
+	view.Size = cachedFile.Size()
+	view.Urls = cachedFile.Urls()
+	view.Aliases = cachedFile.Aliases()
+	view.Attributes = cachedFile.Attributes()
+	view.StorageEngine = blueprint.storageEngine
+	if !cachedFile.Fetched().IsZero() {
+		view.Fetched = cachedFile.Fetched().Format(time.RFC3339)
+	}
+	position, inLru := positions[cachedFile.ContentHash()]
+	if inLru {
+		view.LruPosition = &position
+	}
+	return view
+}
+
+// parseIndexQuery builds an index query from the urlPrefix, aliasPrefix,
+// minSize, maxSize, fetchedBefore, fetchedAfter, sort, offset and limit query
+// string parameters.
+func (blueprint *apiBlueprint) parseIndexQuery(values url.Values) (*IndexQuery, error) {
+	var err error
+	query := new(IndexQuery)
+	query.UrlPrefix = values.Get("urlPrefix")
+	query.AliasPrefix = values.Get("aliasPrefix")
+	query.Limit = defaultEntriesLimit
+
+	intValues := map[string]*int{
+		"minSize": &query.MinSize,
+		"maxSize": &query.MaxSize,
+		"offset":  &query.Offset,
+		"limit":   &query.Limit,
+	}
+	for key, target := range intValues {
+		if value := values.Get(key); value != "" {
+			*target, err = strconv.Atoi(value)
+			if err != nil {
+				return nil, err
+			}
+			if *target < 0 {
+				return nil, errors.New("Invalid " + key + " parameter.")
+			}
+		}
+	}
+	if query.Limit == 0 || query.Limit > maxEntriesLimit {
+		query.Limit = maxEntriesLimit
+	}
+
+	timeValues := map[string]*time.Time{
+		"fetchedBefore": &query.FetchedBefore,
+		"fetchedAfter":  &query.FetchedAfter,
+	}
+	for key, target := range timeValues {
+		if value := values.Get(key); value != "" {
+			*target, err = time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	query.Sort = values.Get("sort")
+	if query.Sort == "" {
+		query.Sort = "hash"
+	}
+	for _, sortOrder := range IndexSortOrders {
+		if query.Sort == sortOrder {
+			return query, nil
+		}
+	}
+	return nil, errors.New("Invalid sort parameter.")
+}
+
+// authorized returns true if the request has a bearer token that matches one
+// of the configured api tokens. When no tokens are configured, no requests
+// are authorized.
+func (blueprint *apiBlueprint) authorized(req *http.Request) bool {
+	authorization := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	token := []byte(strings.TrimPrefix(authorization, "Bearer "))
+	for _, allowedToken := range blueprint.tokens {
+		if allowedToken != "" && subtle.ConstantTimeCompare(token, []byte(allowedToken)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// validAliases returns true if all of the aliases match the configured alias
+// pattern.
+func (blueprint *apiBlueprint) validAliases(aliases []string) bool {
+	for _, alias := range aliases {
+		if !blueprint.aliasPattern.MatchString(alias) {
+			return false
+		}
+	}
+	return true
+}
+
 func (blueprint *apiBlueprint) collectUrl(args map[string][]string) (string, error) {
 	urls, hasUrls := args["url"]
 	if hasUrls && urls != nil && len(urls) > 0 {
@@ -71,3 +674,86 @@ func (blueprint *apiBlueprint) getValues(req *http.Request, keys []string) map[s
 	}
 	return values
 }
+
+// parseWarmRequest reads the url and aliases of a warm request from either a
+// JSON or a form encoded request body.
+func (blueprint *apiBlueprint) parseWarmRequest(req *http.Request) (*warmRequest, error) {
+	warmRequest := new(warmRequest)
+
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		err := json.NewDecoder(req.Body).Decode(warmRequest)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err := req.ParseForm()
+		if err != nil {
+			return nil, err
+		}
+		warmRequest.Url = req.Form.Get("url")
+		warmRequest.Aliases = req.Form["alias"]
+		warmRequest.Digest = req.Form.Get("digest")
+	}
+
+	warmRequest.Aliases = splitAliases(warmRequest.Aliases)
+
+	return warmRequest, nil
+}
+
+// parseOptionalDigest parses the expected digest, returning nil if there is
+// none.
+func parseOptionalDigest(value string) (*util.Digest, error) {
+	if value == "" {
+		return nil, nil
+	}
+	return util.ParseDigest(value)
+}
+
+// splitAliases splits comma separated aliases and returns the distinct,
+// non-empty aliases in the order they were given.
+func splitAliases(values []string) []string {
+	seen := make(map[string]bool)
+	results := make([]string, 0, 0)
+	for _, value := range values {
+		for _, alias := range strings.Split(value, ",") {
+			alias = strings.TrimSpace(alias)
+			if alias != "" && !seen[alias] {
+				seen[alias] = true
+				results = append(results, alias)
+			}
+		}
+	}
+	return results
+}
+
+// isValidUrl returns true if the given url is an absolute http or https url.
+func isValidUrl(rawUrl string) bool {
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return false
+	}
+	return (parsedUrl.Scheme == "http" || parsedUrl.Scheme == "https") && parsedUrl.Host != ""
+}
+
+func newErrorsView(errs ...codederror.CodedError) *errorsView {
+	view := new(errorsView)
+	view.Errors = make([]errorViewError, 0, 0)
+	for _, err := range errs {
+		view.Errors = append(view.Errors, errorViewError{err.Error(), err.Description()})
+	}
+	return view
+}
+
+func writeJson(res http.ResponseWriter, status int, view interface{}) {
+	body, err := json.Marshal(view)
+	if err != nil {
+		res.WriteHeader(500)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	res.WriteHeader(status)
+	res.Write(body)
+}
@@ -0,0 +1,161 @@
+package app
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ngerakines/codederror"
+	"github.com/ngerakines/tram/config"
+	"github.com/ngerakines/tram/util"
+)
+
+// warmErrorFileCache is a file cache whose Warm always returns an error.
+type warmErrorFileCache struct {
+	FileCache
+	err error
+}
+
+func (fileCache *warmErrorFileCache) Warm(url string, aliases []string, digest *util.Digest) (CachedFile, error) {
+	return nil, fileCache.err
+}
+
+// indexFileCache is a file cache that peeks at the records of an index.
+type indexFileCache struct {
+	FileCache
+	index Index
+}
+
+func (fileCache *indexFileCache) Peek(contentHash string) CachedFile {
+	cachedFile, err := fileCache.index.Get(contentHash)
+	if err != nil {
+		return nil
+	}
+	return cachedFile
+}
+
+func TestWarmErrors(t *testing.T) {
+	tests := []struct {
+		err            error
+		status         string
+		responseStatus int
+		expected       codederror.CodedError
+	}{
+		{ErrorQueueFull, "rejected", 503, ErrorQueueFull},
+		{ErrorChecksumMismatch, "failed", 502, ErrorChecksumMismatch},
+		{ErrorDigestUnavailable, "failed", 409, ErrorDigestUnavailable},
+		{ErrorAliasConflict, "failed", 409, ErrorAliasConflict},
+		{ErrorStorageFailed, "failed", 500, ErrorStorageFailed},
+		{&util.FetchError{Url: "http://example.com/", StatusCode: 404}, "failed", 502, ErrorUpstreamStatus},
+		{&util.FetchError{Url: "http://example.com/", Err: &util.BlockedError{Url: "http://example.com/", Reason: "denied"}}, "failed", 403, ErrorOriginNotAllowed},
+	}
+	for _, test := range tests {
+		blueprint, err := newApiBlueprint(new(config.AppConfig), &warmErrorFileCache{err: test.err}, nil, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		view, status := blueprint.(*apiBlueprint).warm(&warmRequest{Url: "http://example.com/"})
+		if view.Status != test.status || status != test.responseStatus || len(view.Errors) != 1 || view.Errors[0].Code != test.expected.Error() {
+			t.Error("Unexpected view", view.Status, status, view.Errors, "for", test.err)
+		}
+	}
+}
+
+func TestDefaultAliasPattern(t *testing.T) {
+	blueprint, err := newApiBlueprint(new(config.AppConfig), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, alias := range []string{"home", "release-1.0", "builds/latest", "tag:v1.0", "a+b"} {
+		if !blueprint.(*apiBlueprint).validAliases([]string{alias}) {
+			t.Error("Expected", alias, "to be a valid alias")
+		}
+	}
+	for _, alias := range []string{"http://example.com/", "a:/b", "-home", "a b", ""} {
+		if blueprint.(*apiBlueprint).validAliases([]string{alias}) {
+			t.Error("Expected", alias, "not to be a valid alias")
+		}
+	}
+}
+
+func TestLookupContentHash(t *testing.T) {
+	path, err := ioutil.TempDir("", "tram-index")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(path)
+
+	a, b := strings.Repeat("a", 40), strings.Repeat("b", 40)
+	index := newLocalIndex(path)
+	index.Update(newTestCachedFile(a, "http://a.example.com/", "a", 10, time.Now()))
+	index.Update(newTestCachedFile(b, "http://b.example.com/", "b", 10, time.Now()))
+	blueprint, err := newApiBlueprint(new(config.AppConfig), nil, index, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := []struct {
+		query       string
+		contentHash string
+		status      int
+	}{
+		{"hash=" + b, b, 200},
+		{"url=http://a.example.com/", a, 200},
+		{"alias=b", b, 200},
+		{"url=http://a.example.com/&alias=b", "", 400},
+		{"url=http://a.example.com/&hash=" + b, "", 400},
+		{"alias=a,b", "", 400},
+		{"url=http://c.example.com/", "", 404},
+		{"alias=http://a.example.com/", "", 404},
+		{"hash=invalid", "", 404},
+		{"", "", 404},
+	}
+	for _, test := range tests {
+		values, _ := url.ParseQuery(test.query)
+		contentHash, status, _ := blueprint.(*apiBlueprint).lookupContentHash(values)
+		if contentHash != test.contentHash || status != test.status {
+			t.Error("Unexpected content hash", contentHash, "and status", status, "for", test.query)
+		}
+	}
+}
+
+func TestHeadProbesUrlAlone(t *testing.T) {
+	path, err := ioutil.TempDir("", "tram-index")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(path)
+
+	index := newLocalIndex(path)
+	index.Update(newTestCachedFile(strings.Repeat("b", 40), "http://b.example.com/", "b", 10, time.Now()))
+	blueprint, err := newApiBlueprint(new(config.AppConfig), &indexFileCache{index: index}, index, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"url=http://b.example.com/", 200},
+		{"alias=b", 200},
+		{"url=http://c.example.com/&alias=b", 404},
+		{"alias=http://b.example.com/", 400},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("HEAD", "/?"+test.query, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		res := httptest.NewRecorder()
+		blueprint.(*apiBlueprint).handleHead(res, req)
+		if res.Code != test.status {
+			t.Error("Expected", test.status, "but found", res.Code, "for", test.query)
+		}
+	}
+}
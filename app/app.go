@@ -24,6 +24,7 @@ type AppContext struct {
 	index          Index
 	storageManager StorageManager
 	fileCache      FileCache
+	rateLimiters   *util.RateLimiters
 	apiBlueprint   Blueprint
 	adminBlueprint Blueprint
 	negroni        *negroni.Negroni
@@ -110,17 +111,28 @@ func (app *AppContext) initCache() error {
 		}
 	}
 
-	app.fileCache = newDiskFileCache(app.appConfig, app.index, app.storageManager, util.DedupeWrapDownloader(util.DefaultRemoteFileFetcher))
+	_, err := util.NewHash(hashAlgorithm(app.appConfig))
+	if err != nil {
+		return err
+	}
+
+	app.rateLimiters = util.NewRateLimiters()
+	downloader := util.RateLimitedFetcher(util.DefaultRemoteFileFetcher, app.rateLimiters)
+	app.fileCache = newDiskFileCache(app.appConfig, app.registry, app.index, app.storageManager, downloader)
 	return nil
 }
 
 func (app *AppContext) initApis() error {
 	p := pat.New()
 
-	app.apiBlueprint = newApiBlueprint(app.fileCache, app.storageManager)
+	apiBlueprint, err := newApiBlueprint(app.appConfig, app.fileCache, app.index, app.storageManager)
+	if err != nil {
+		return err
+	}
+	app.apiBlueprint = apiBlueprint
 	app.apiBlueprint.AddRoutes(p)
 
-	app.adminBlueprint = newAdminBlueprint(app.registry, app.appConfig)
+	app.adminBlueprint = newAdminBlueprint(app.registry, app.appConfig, app.rateLimiters)
 	app.adminBlueprint.AddRoutes(p)
 
 	app.negroni = negroni.Classic()
@@ -3,73 +3,331 @@ package app
 import (
 	"github.com/ngerakines/tram/config"
 	"github.com/ngerakines/tram/util"
+	"github.com/rcrowley/go-metrics"
+	"io"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strings"
 	"time"
 )
 
 type warmAndQueryCachedFiles struct {
 	Url      string
 	Aliases  []string
-	Response chan CachedFile
+	Digest   *util.Digest
+	Priority int
+	Response chan downloadResult
+	Ack      chan error
+}
+
+// checksumMismatch is the error returned when downloaded content does not
+// match the digest that a listener expects. The digests of the discarded
+// content are kept so that each waiting listener can be checked against them.
+type checksumMismatch struct {
+	Digests map[string]string
+}
+
+func (err *checksumMismatch) Error() string {
+	return ErrorChecksumMismatch.Error()
+}
+
+// revalidation is the result of a conditional request for the url of a
+// cached file. It is applied to the indexed record by the run loop, so that
+// urls and aliases merged while the request was made are kept.
+type revalidation struct {
+	Url         string
+	ContentHash string
+	// Attributes are set on the revalidated content when it is unchanged or
+	// could not be revalidated.
+	Attributes map[string]string
+	// Replacement is the content that replaced the revalidated content, if
+	// it has changed.
+	Replacement CachedFile
+}
+
+// purgeCachedFile asks the run loop to purge the cached file, so that it is
+// not updated by a download or revalidation while it is being removed.
+type purgeCachedFile struct {
+	CachedFile CachedFile
+	Response   chan downloadResult
+}
+
+// downloadFailure describes a download that could not be completed.
+type downloadFailure struct {
+	Url string
+	Err error
 }
 
 type FileCache interface {
-	WarmAndQuery(url string, aliases []string) CachedFile
+	WarmAndQuery(url string, aliases []string, digest *util.Digest) (CachedFile, error)
+	Warm(url string, aliases []string, digest *util.Digest) (CachedFile, error)
+	Get(contentHash string) CachedFile
+	Peek(contentHash string) CachedFile
+	Query(aliases []string) CachedFile
+	Purge(cachedFile CachedFile) (CachedFile, error)
+	LruPositions(contentHashes []string) map[string]int
 }
 
 type diskFileCache struct {
 	appConfig *config.AppConfig
 
-	warmAndQuery chan warmAndQueryCachedFiles
-	downloads    chan CachedFile
-	evictions    chan *Item
+	warmAndQuery  chan warmAndQueryCachedFiles
+	purges        chan purgeCachedFile
+	downloads     chan CachedFile
+	revalidations chan revalidation
+	failures      chan downloadFailure
+	evictions     chan *Item
 
-	downloader        util.RemoteFileFetcher
-	downloadListeners *DownloadListeners
-	downloadPool      *util.DownloadPool
+	downloader         util.RemoteFileFetcher
+	headers            []string
+	spoolPath          string
+	hashAlgorithm      string
+	waitTimeout        time.Duration
+	listenerTimeout    time.Duration
+	revalidateInterval time.Duration
+	downloadListeners  *DownloadListeners
+	downloadPool       *util.DownloadPool
+	workers            *util.WorkerPool
 
 	lru *LRUCache
 
+	// revalidating holds the urls with a revalidation in progress. It is only
+	// used by the run loop.
+	revalidating map[string]bool
+
 	index          Index
 	storageManager StorageManager
+
+	inTransitGauge   metrics.Gauge
+	waitersGauge     metrics.Gauge
+	coalescedCounter metrics.Counter
+	reapedCounter    metrics.Counter
+	queuedGauge      metrics.Gauge
+	runningGauge     metrics.Gauge
+	rejectedCounter  metrics.Counter
+
+	unchangedCounter metrics.Counter
+	changedCounter   metrics.Counter
+	staleCounter     metrics.Counter
 }
 
-func newDiskFileCache(appConfig *config.AppConfig, index Index, storageManager StorageManager, downloader util.RemoteFileFetcher) FileCache {
+const (
+	defaultWaitTimeout     = 30
+	defaultListenerTimeout = 120
+	reapInterval           = 10 * time.Second
+	defaultConcurrency     = 16
+	defaultPerHost         = 4
+	defaultQueueSize       = 1024
+)
+
+func newDiskFileCache(appConfig *config.AppConfig, registry metrics.Registry, index Index, storageManager StorageManager, downloader util.RemoteFileFetcher) FileCache {
 	fileCache := new(diskFileCache)
 	fileCache.appConfig = appConfig
 	fileCache.index = index
 	fileCache.storageManager = storageManager
 	fileCache.downloader = downloader
+	fileCache.headers = appConfig.Fetch.Headers
+	if len(fileCache.headers) == 0 {
+		fileCache.headers = DefaultCachedHeaders
+	}
+	fileCache.hashAlgorithm = hashAlgorithm(appConfig)
+	fileCache.spoolPath = spoolPath(appConfig)
+	err := os.MkdirAll(fileCache.spoolPath, 0777)
+	if err != nil {
+		panic(err)
+	}
+	if fileCache.spoolPath != os.TempDir() {
+		cleanSpoolPath(fileCache.spoolPath)
+	}
+
+	fileCache.waitTimeout = time.Duration(defaultWaitTimeout) * time.Second
+	if appConfig.Cache.WaitTimeout > 0 {
+		fileCache.waitTimeout = time.Duration(appConfig.Cache.WaitTimeout) * time.Second
+	}
+	fileCache.listenerTimeout = time.Duration(defaultListenerTimeout) * time.Second
+	if appConfig.Cache.ListenerTimeout > 0 {
+		fileCache.listenerTimeout = time.Duration(appConfig.Cache.ListenerTimeout) * time.Second
+	}
+
+	fileCache.revalidateInterval = time.Duration(appConfig.Cache.RevalidateInterval) * time.Second
+	fileCache.revalidating = make(map[string]bool)
 
 	fileCache.warmAndQuery = make(chan warmAndQueryCachedFiles, 1024)
+	fileCache.purges = make(chan purgeCachedFile, 25)
 	fileCache.downloads = make(chan CachedFile, 25)
+	fileCache.revalidations = make(chan revalidation, 25)
+	fileCache.failures = make(chan downloadFailure, 25)
 	fileCache.downloadListeners = NewDownloadListeners()
+	fileCache.downloadPool = util.NewDownloadPool()
+	fileCache.workers = newWorkerPool(appConfig)
 	fileCache.evictions = make(chan *Item, 25)
 	fileCache.lru = NewLRUCache(appConfig.LruSize)
 
+	fileCache.inTransitGauge = metrics.NewRegisteredGauge("downloads.inTransit", registry)
+	fileCache.waitersGauge = metrics.NewRegisteredGauge("downloads.waiters", registry)
+	fileCache.coalescedCounter = metrics.NewRegisteredCounter("downloads.coalesced", registry)
+	fileCache.reapedCounter = metrics.NewRegisteredCounter("downloads.reaped", registry)
+	fileCache.queuedGauge = metrics.NewRegisteredGauge("downloads.queued", registry)
+	fileCache.runningGauge = metrics.NewRegisteredGauge("downloads.running", registry)
+	fileCache.rejectedCounter = metrics.NewRegisteredCounter("downloads.rejected", registry)
+	fileCache.unchangedCounter = metrics.NewRegisteredCounter("revalidations.unchanged", registry)
+	fileCache.changedCounter = metrics.NewRegisteredCounter("revalidations.changed", registry)
+	fileCache.staleCounter = metrics.NewRegisteredCounter("revalidations.stale", registry)
+
 	fileCache.lru.AddListener(fileCache.evictions)
 	go fileCache.run()
 
 	return fileCache
 }
 
+// newWorkerPool creates the pool that downloads are run by, using the
+// configured limits or the defaults.
+func newWorkerPool(appConfig *config.AppConfig) *util.WorkerPool {
+	concurrency := appConfig.Workers.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	perHost := appConfig.Workers.PerHost
+	if perHost <= 0 {
+		perHost = defaultPerHost
+	}
+	queueSize := appConfig.Workers.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	return util.NewWorkerPool(concurrency, perHost, queueSize)
+}
+
 func (fileCache *diskFileCache) Close() {
 	close(fileCache.warmAndQuery)
 }
 
-func (fileCache *diskFileCache) WarmAndQuery(url string, aliases []string) CachedFile {
-	command := warmAndQueryCachedFiles{url, aliases, make(chan CachedFile)}
-	defer close(command.Response)
+// WarmAndQuery returns the cached file for the url, downloading the url if it
+// has not been cached, and attaches the aliases to it. If the download fails,
+// does not match the expected digest, has an alias that refers to other
+// content or does not complete in time, the error is returned.
+func (fileCache *diskFileCache) WarmAndQuery(url string, aliases []string, digest *util.Digest) (CachedFile, error) {
+	command := warmAndQueryCachedFiles{url, aliases, digest, util.PriorityInteractive, make(chan downloadResult, 1), nil}
+	fileCache.warmAndQuery <- command
+
+	select {
+	case result := <-command.Response:
+		return result.cachedFile, result.err
+	case <-time.After(fileCache.waitTimeout):
+		// The download continues and is cached when it completes, but this
+		// client is no longer waiting on it.
+		fileCache.downloadListeners.Remove(command.Response)
+		return nil, ErrorDownloadTimeout
+	}
+}
+
+// Warm queues the url to be downloaded, behind any downloads that clients
+// are waiting on, without waiting for the download to complete. If the url is
+// already cached, the cached file is returned, otherwise nil is returned. If
+// the download could not be queued, the cached file does not match the
+// expected digest or an alias refers to other content, the error is returned.
+func (fileCache *diskFileCache) Warm(url string, aliases []string, digest *util.Digest) (CachedFile, error) {
+	command := warmAndQueryCachedFiles{url, aliases, digest, util.PriorityBulk, make(chan downloadResult, 1), make(chan error, 1)}
 	fileCache.warmAndQuery <- command
+	err := <-command.Ack
+	if err != nil {
+		return nil, err
+	}
 
 	select {
 	case result := <-command.Response:
-		return result
-	case <-time.After(30 * time.Second):
+		return result.cachedFile, result.err
+	default:
+		return nil, nil
+	}
+}
+
+// Get returns the cached file for the content hash without triggering a
+// download. The indexed record is preferred because it includes urls and
+// aliases merged after the content was downloaded. If the content hash is not
+// known, nil is returned.
+func (fileCache *diskFileCache) Get(contentHash string) CachedFile {
+	cachedFile, hasCachedFile := fileCache.lru.Get(contentHash)
+	indexedFile, err := fileCache.index.Get(contentHash)
+	if err == nil {
+		return indexedFile
+	}
+	if hasCachedFile {
+		return cachedFile.(CachedFile)
+	}
+	return nil
+}
+
+// Peek returns the cached file for the content hash like Get, but without
+// promoting it in the lru.
+func (fileCache *diskFileCache) Peek(contentHash string) CachedFile {
+	indexedFile, err := fileCache.index.Get(contentHash)
+	if err == nil {
+		return indexedFile
+	}
+	cachedFile, hasCachedFile := fileCache.lru.Peek(contentHash)
+	if hasCachedFile {
+		return cachedFile.(CachedFile)
+	}
+	return nil
+}
+
+// Query returns the cached file for the first of the aliases that is known
+// without triggering a download. If none of the aliases are known, nil is
+// returned.
+func (fileCache *diskFileCache) Query(aliases []string) CachedFile {
+	contentHash, err := fileCache.index.FindAlias(aliases)
+	if err != nil {
 		return nil
 	}
+	return fileCache.Get(contentHash)
+}
+
+// Purge removes the cached file from the lru, storage and index. The indexed
+// record of the cached file, including all of the urls and aliases that were
+// detached from the content, is returned.
+func (fileCache *diskFileCache) Purge(cachedFile CachedFile) (CachedFile, error) {
+	command := purgeCachedFile{cachedFile, make(chan downloadResult, 1)}
+	fileCache.purges <- command
+	result := <-command.Response
+	return result.cachedFile, result.err
+}
+
+// purge removes the cached file from the lru, storage and index. It is only
+// called by the run loop.
+func (fileCache *diskFileCache) purge(cachedFile CachedFile) (CachedFile, error) {
+	contentHash := cachedFile.ContentHash()
+	indexedFile, err := fileCache.index.Get(contentHash)
+	if err != nil {
+		indexedFile = cachedFile
+	}
+
+	// Storage is deleted first so that content that could not be deleted is
+	// still tracked by the lru and index.
+	err = fileCache.storageManager.Delete(cachedFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	fileCache.lru.Delete(contentHash)
+	err = fileCache.index.Clear(contentHash)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	log.Println("Purged content", contentHash)
+	return indexedFile, nil
+}
+
+// LruPositions returns the positions in the lru of the content hashes that
+// are in it, without promoting them.
+func (fileCache *diskFileCache) LruPositions(contentHashes []string) map[string]int {
+	return fileCache.lru.Positions(contentHashes)
 }
 
 func (fileCache *diskFileCache) run() {
+	reaper := time.NewTicker(reapInterval)
+	defer reaper.Stop()
 	for {
 		select {
 		case command, ok := <-fileCache.warmAndQuery:
@@ -77,7 +335,19 @@ func (fileCache *diskFileCache) run() {
 				if !ok {
 					return
 				}
-				fileCache.downloadAndNotify(command.Url, command.Aliases, command.Response)
+				err := fileCache.downloadAndNotify(command.Url, command.Aliases, command.Digest, command.Priority, command.Response)
+				fileCache.updateDownloadMetrics()
+				if command.Ack != nil {
+					command.Ack <- err
+				}
+			}
+		case command, ok := <-fileCache.purges:
+			{
+				if !ok {
+					return
+				}
+				purgedFile, err := fileCache.purge(command.CachedFile)
+				command.Response <- downloadResult{purgedFile, err}
 			}
 		case cachedFile, ok := <-fileCache.downloads:
 			{
@@ -85,6 +355,27 @@ func (fileCache *diskFileCache) run() {
 					return
 				}
 				fileCache.handleDownload(cachedFile)
+				fileCache.updateDownloadMetrics()
+			}
+		case result, ok := <-fileCache.revalidations:
+			{
+				if !ok {
+					return
+				}
+				fileCache.handleRevalidation(result)
+				fileCache.updateDownloadMetrics()
+			}
+		case failure, ok := <-fileCache.failures:
+			{
+				if !ok {
+					return
+				}
+				if mismatch, isMismatch := failure.Err.(*checksumMismatch); isMismatch {
+					fileCache.handleMismatch(failure.Url, mismatch)
+				} else {
+					fileCache.downloadListeners.NotifyError(failure.Url, failure.Err)
+				}
+				fileCache.updateDownloadMetrics()
 			}
 		case evicted, ok := <-fileCache.evictions:
 			{
@@ -93,15 +384,26 @@ func (fileCache *diskFileCache) run() {
 				}
 				fileCache.handleEviction(evicted)
 			}
+		case <-reaper.C:
+			{
+				fileCache.reapListeners()
+			}
 		}
 	}
 }
 
-func (fileCache *diskFileCache) findCachedFile(terms []string) CachedFile {
-	contentHash, err := fileCache.index.Find(terms)
+// findCachedFile returns the cached file for the url, preferring the indexed
+// record because it includes urls and aliases merged after the content was
+// downloaded. Aliases are never used to find the cached file for a url.
+func (fileCache *diskFileCache) findCachedFile(url string) CachedFile {
+	contentHash, err := fileCache.index.FindUrl(url)
 	if err == nil {
 		cachedFile, hasCachedFile := fileCache.lru.Get(contentHash)
 		if hasCachedFile {
+			indexedFile, err := fileCache.index.Get(contentHash)
+			if err == nil {
+				return indexedFile
+			}
 			return cachedFile.(CachedFile)
 		}
 	}
@@ -109,21 +411,426 @@ func (fileCache *diskFileCache) findCachedFile(terms []string) CachedFile {
 	return nil
 }
 
-func (fileCache *diskFileCache) downloadAndNotify(url string, urlAliases []string, channel chan CachedFile) {
-	existingCachedFile := fileCache.findCachedFile(append(urlAliases, url))
+// downloadAndNotify sends the cached file for the url to the channel,
+// queueing a download if it is not cached, and attaches the aliases to it. If
+// the download could not be queued, the channel is sent the error, which is
+// also returned.
+func (fileCache *diskFileCache) downloadAndNotify(url string, urlAliases []string, digest *util.Digest, priority int, channel chan downloadResult) error {
+	existingCachedFile := fileCache.findCachedFile(url)
 	if existingCachedFile != nil {
-		fileCache.index.Merge(existingCachedFile, urlAliases, []string{url})
-		channel <- existingCachedFile
+		if fileCache.shouldRevalidate(url, existingCachedFile) {
+			fileCache.revalidateInBackground(url, priority, existingCachedFile)
+		}
+		err := verifyDigest(existingCachedFile, digest)
+		if err == nil {
+			existingCachedFile, err = fileCache.attach(existingCachedFile, urlAliases)
+		}
+		if err != nil {
+			sendResult(channel, downloadResult{nil, err})
+			return nil
+		}
+		sendResult(channel, downloadResult{existingCachedFile, nil})
+		return nil
+	}
+	// Requests for a url that is already being downloaded wait on that
+	// download rather than starting another. A client waiting on a queued
+	// warm download moves it ahead of the other warm downloads.
+	inTransit := fileCache.downloadListeners.Waiting(url)
+	fileCache.downloadListeners.Add(url, urlAliases, digest, channel)
+	if inTransit {
+		fileCache.coalescedCounter.Inc(1)
+		fileCache.workers.Promote(url, priority)
+		return nil
+	}
+
+	return fileCache.submit(url, priority, func() {
+		fileCache.download(url)
+	})
+}
+
+// revalidateInBackground queues a conditional request for the url of the
+// cached file unless one is already in progress. The cached file continues to
+// be served while it is revalidated.
+func (fileCache *diskFileCache) revalidateInBackground(url string, priority int, cachedFile CachedFile) {
+	if fileCache.revalidating[url] {
 		return
 	}
-	fileCache.downloadListeners.Add(url, urlAliases, channel)
-	go Download(fileCache.downloader, fileCache.storageManager, url, urlAliases, fileCache.downloads)
+	fileCache.revalidating[url] = true
+	err := fileCache.submit(url, priority, func() {
+		fileCache.revalidate(url, cachedFile)
+	})
+	if err != nil {
+		delete(fileCache.revalidating, url)
+	}
+}
+
+// submit queues the job to download the url. If the queue is full, the
+// listeners waiting on the url are sent ErrorQueueFull, which is also
+// returned.
+func (fileCache *diskFileCache) submit(url string, priority int, run func()) error {
+	job := util.Job{Key: url, Host: urlHost(url), Priority: priority, Run: run}
+	origin := fileCache.appConfig.Origin(url)
+	if origin != nil {
+		job.HostLimit = origin.MaxConcurrency
+	}
+	err := fileCache.workers.Submit(job)
+	if err != nil {
+		log.Println("Not downloading", url, err.Error())
+		fileCache.rejectedCounter.Inc(1)
+		fileCache.downloadListeners.NotifyError(url, ErrorQueueFull)
+		return ErrorQueueFull
+	}
+	return nil
+}
+
+// shouldRevalidate returns true if revalidation is enabled, the url belongs
+// to the cached file, the origin gave validators for it and it has not been
+// validated within the revalidate interval.
+func (fileCache *diskFileCache) shouldRevalidate(url string, cachedFile CachedFile) bool {
+	if fileCache.revalidateInterval <= 0 || !contains(cachedFile.Urls(), url) {
+		return false
+	}
+	attributes := cachedFile.Attributes()
+	_, hasETag := attributes[validatorAttributePrefix+"ETag"]
+	_, hasLastModified := attributes[validatorAttributePrefix+"Last-Modified"]
+	if !hasETag && !hasLastModified {
+		return false
+	}
+	return time.Since(lastValidated(cachedFile)) > fileCache.revalidateInterval
+}
+
+// revalidate sends a conditional request for the url of the cached file. The
+// cached file is kept if the origin has not changed it and replaced if it
+// has. If the origin cannot be reached, the cached file continues to be
+// served and the attempt is recorded so that it is not revalidated again
+// until the revalidate interval has passed. The result is sent to the run
+// loop to be applied to the index.
+func (fileCache *diskFileCache) revalidate(url string, cachedFile CachedFile) {
+	// The indexed record has the validators of the most recent revalidation.
+	indexedFile, err := fileCache.index.Get(cachedFile.ContentHash())
+	if err == nil {
+		cachedFile = indexedFile
+	}
+	value, err, _ := fileCache.downloadPool.Do(url, func() (interface{}, error) {
+		return fileCache.fetchAndStore(url, cachedFile)
+	})
+	result := revalidation{Url: url, ContentHash: cachedFile.ContentHash()}
+	if err != nil {
+		log.Println("Could not revalidate", url, "so the cached content is served:", err.Error())
+		fileCache.staleCounter.Inc(1)
+		result.Attributes = revalidatedAttributes(map[string]string{}, http.Header{})
+	} else if updatedFile := value.(CachedFile); updatedFile.ContentHash() != cachedFile.ContentHash() {
+		result.Replacement = updatedFile
+	} else {
+		result.Attributes = changedAttributes(cachedFile.Attributes(), updatedFile.Attributes())
+	}
+	fileCache.revalidations <- result
+}
+
+func urlHost(rawUrl string) string {
+	parsedUrl, err := neturl.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsedUrl.Host)
+}
+
+// download fetches and stores the url, sharing the result with any concurrent
+// downloads of the same url. The result is sent to the downloads or failures
+// channel so that waiting listeners can be notified.
+func (fileCache *diskFileCache) download(url string) {
+	// Every caller sends the result, including those that shared a download
+	// started by another, because the listeners that caused the download to
+	// start may have been reaped.
+	value, err, _ := fileCache.downloadPool.Do(url, func() (interface{}, error) {
+		return fileCache.fetchAndStore(url, nil)
+	})
+	if err != nil {
+		fileCache.failures <- downloadFailure{url, err}
+		return
+	}
+	fileCache.downloads <- value.(CachedFile)
+}
+
+// fetchAndStore streams the url to a spooled file and then commits it to
+// storage. If the content does not match the digest that any waiting listener
+// expects, it is discarded and a checksumMismatch is returned. Aliases are
+// attached as each waiting listener is notified. When a previous cached
+// file is given, the request is made conditional on its validators and a
+// copy of the previous cached file with updated attributes is returned if
+// the content has not changed. The index is not changed.
+func (fileCache *diskFileCache) fetchAndStore(url string, previous CachedFile) (CachedFile, error) {
+	options, err := fileCache.fetchOptions(url)
+	if err != nil {
+		log.Println("Could not load the fetch options for", url, err.Error())
+		return nil, &util.FetchError{Url: url, Err: err}
+	}
+	if previous != nil {
+		options.IfNoneMatch = previous.Attributes()[validatorAttributePrefix+"ETag"]
+		options.IfModifiedSince = previous.Attributes()[validatorAttributePrefix+"Last-Modified"]
+	}
+	remoteFile, err := fileCache.downloader(url, options)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer remoteFile.Body.Close()
+
+	if previous != nil && remoteFile.StatusCode == http.StatusNotModified {
+		log.Println("The content of", url, "has not changed")
+		fileCache.unchangedCounter.Inc(1)
+		return withAttributes(previous, revalidatedAttributes(previous.Attributes(), remoteFile.Header)), nil
+	}
+
+	var body io.Reader = remoteFile.Body
+	maxSize := fileCache.maxSize(url)
+	if maxSize > 0 {
+		if remoteFile.ContentLength > maxSize {
+			log.Println("Not downloading", url, "because its content length", remoteFile.ContentLength, "is larger than", maxSize)
+			return nil, ErrorObjectTooLarge
+		}
+		body = &maxSizeReader{body, maxSize}
+	}
+
+	spooledFile, err := spool(fileCache.spoolPath, url, body, fileCache.hashAlgorithm, util.DigestAlgorithms)
+	if err != nil {
+		log.Println(err.Error())
+		if !isDownloadError(err) {
+			err = ErrorStorageFailed
+		}
+		return nil, err
+	}
+	defer os.Remove(spooledFile.Path)
+
+	for _, digest := range fileCache.downloadListeners.Digests(url) {
+		if !matchesDigest(spooledFile.Digests, digest) {
+			log.Println("Not storing", url, "because it does not match the expected digest", digest.String())
+			return nil, &checksumMismatch{spooledFile.Digests}
+		}
+	}
+
+	attributes := headerAttributes(remoteFile.Header, fileCache.headers)
+	for name, value := range digestAttributes(spooledFile) {
+		attributes[name] = value
+	}
+	for name, value := range validatorAttributes(remoteFile.Header) {
+		attributes[name] = value
+	}
+
+	if previous != nil && spooledFile.ContentHash == previous.ContentHash() {
+		log.Println("The content of", url, "was downloaded again but has not changed")
+		fileCache.unchangedCounter.Inc(1)
+		// The previous attributes include those set by the storage manager.
+		updatedAttributes := make(map[string]string)
+		for name, value := range previous.Attributes() {
+			updatedAttributes[name] = value
+		}
+		for name, value := range attributes {
+			updatedAttributes[name] = value
+		}
+		return withAttributes(previous, revalidatedAttributes(updatedAttributes, remoteFile.Header)), nil
+	}
+
+	cachedFile, err := fileCache.storageManager.Store(spooledFile, []string{url}, []string{}, attributes)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, ErrorStorageFailed
+	}
+
+	if previous != nil {
+		log.Println("The content of", url, "has changed from", previous.ContentHash(), "to", cachedFile.ContentHash())
+		fileCache.changedCounter.Inc(1)
+	}
+	return cachedFile, nil
+}
+
+// handleMismatch notifies the listeners whose expected digest the discarded
+// content did not match. The url is downloaded again for any other listeners
+// that are still waiting on it.
+func (fileCache *diskFileCache) handleMismatch(url string, mismatch *checksumMismatch) {
+	if fileCache.downloadListeners.NotifyMismatch(url, mismatch.Digests) {
+		fileCache.submit(url, util.PriorityInteractive, func() {
+			fileCache.download(url)
+		})
+	}
+}
+
+// handleRevalidation applies the result of a revalidation to the indexed
+// record of the revalidated content. When the content has changed, the url is
+// moved to the new content and the previous content keeps its other urls and
+// aliases.
+func (fileCache *diskFileCache) handleRevalidation(result revalidation) {
+	delete(fileCache.revalidating, result.Url)
+	if result.Replacement != nil {
+		fileCache.handleDownload(result.Replacement)
+		fileCache.index.Detach(result.ContentHash, []string{result.Url})
+		return
+	}
+	indexedFile, err := fileCache.index.Get(result.ContentHash)
+	if err != nil {
+		log.Println("Not updating", result.ContentHash, "because it was removed while", result.Url, "was revalidated")
+		return
+	}
+	attributes := make(map[string]string)
+	for name, value := range indexedFile.Attributes() {
+		attributes[name] = value
+	}
+	for name, value := range result.Attributes {
+		attributes[name] = value
+	}
+	fileCache.index.Update(withAttributes(indexedFile, attributes))
+}
+
+// revalidatedAttributes returns a copy of the attributes with the validators
+// from the response and the time that the content was validated.
+func revalidatedAttributes(attributes map[string]string, header http.Header) map[string]string {
+	updatedAttributes := make(map[string]string)
+	for name, value := range attributes {
+		updatedAttributes[name] = value
+	}
+	for name, value := range validatorAttributes(header) {
+		updatedAttributes[name] = value
+	}
+	updatedAttributes[validatedAttribute] = time.Now().UTC().Format(time.RFC3339)
+	return updatedAttributes
+}
+
+// changedAttributes returns the attributes that were added or changed.
+func changedAttributes(previous, updated map[string]string) map[string]string {
+	changed := make(map[string]string)
+	for name, value := range updated {
+		if previousValue, hasPrevious := previous[name]; !hasPrevious || previousValue != value {
+			changed[name] = value
+		}
+	}
+	return changed
+}
+
+// maxSize returns the maximum size of the content of the url, preferring the
+// size configured for its origin. Zero means that there is no maximum.
+func (fileCache *diskFileCache) maxSize(url string) int64 {
+	origin := fileCache.appConfig.Origin(url)
+	if origin != nil && origin.MaxSize > 0 {
+		return origin.MaxSize
+	}
+	return fileCache.appConfig.Fetch.MaxSize
+}
+
+// isDownloadError returns true if the error was caused by the origin or the
+// content rather than by storage.
+func isDownloadError(err error) bool {
+	if _, isFetchError := err.(*util.FetchError); isFetchError {
+		return true
+	}
+	return isCodedError(err, ErrorObjectTooLarge)
+}
+
+// fetchOptions returns the options used to fetch the url. The request headers
+// of the origin may contain credentials, so they are only ever passed to the
+// downloader and never stored with the cached file.
+func (fileCache *diskFileCache) fetchOptions(url string) (util.FetchOptions, error) {
+	options := util.DefaultFetchOptions()
+	options.CacheableStatusCodes = fileCache.appConfig.Fetch.CacheableStatusCodes
+	options.Allow = fileCache.appConfig.Fetch.Allow
+	options.Deny = fileCache.appConfig.Fetch.Deny
+	options.AllowedNetworks = fileCache.appConfig.Fetch.AllowedNetworks
+
+	settings := fileCache.appConfig.FetchSettings(url)
+	if settings.ConnectTimeout > 0 {
+		options.ConnectTimeout = time.Duration(settings.ConnectTimeout) * time.Second
+	}
+	if settings.HeaderTimeout > 0 {
+		options.HeaderTimeout = time.Duration(settings.HeaderTimeout) * time.Second
+	}
+	if settings.IdleTimeout > 0 {
+		options.IdleTimeout = time.Duration(settings.IdleTimeout) * time.Second
+	}
+	if settings.TotalTimeout > 0 {
+		options.TotalTimeout = time.Duration(settings.TotalTimeout) * time.Second
+	}
+	if settings.Retries != nil {
+		options.Retries = *settings.Retries
+	}
+	if settings.RetryBackoff > 0 {
+		options.RetryBackoff = time.Duration(settings.RetryBackoff) * time.Millisecond
+	}
+	if settings.MaxRetryBackoff > 0 {
+		options.MaxRetryBackoff = time.Duration(settings.MaxRetryBackoff) * time.Millisecond
+	}
+	options.CaBundles = settings.CaBundles
+	options.ClientCert = settings.ClientCert
+	options.ClientKey = settings.ClientKey
+	options.Proxy = settings.Proxy
+	options.RequestsPerSecond = settings.RequestsPerSecond
+	options.BytesPerSecond = settings.BytesPerSecond
+	options.NoProxy = fileCache.appConfig.Fetch.NoProxy
+
+	origin := fileCache.appConfig.Origin(url)
+	if origin != nil {
+		options.InsecureSkipVerify = origin.Insecure
+		header, err := origin.RequestHeader()
+		if err != nil {
+			return options, err
+		}
+		options.Header = header
+	}
+	return options, nil
 }
 
 func (fileCache *diskFileCache) handleDownload(cachedFile CachedFile) {
 	fileCache.lru.Set(cachedFile.ContentHash(), cachedFile)
 	fileCache.index.Update(cachedFile)
-	fileCache.downloadListeners.Notify(cachedFile)
+	fileCache.downloadListeners.Notify(cachedFile, fileCache.attach)
+}
+
+// attach adds the aliases to the cached file and returns its indexed record.
+// An alias that already refers to other content is never moved, and an alias
+// that is a known url is never attached. ErrorAliasConflict is returned
+// instead.
+func (fileCache *diskFileCache) attach(cachedFile CachedFile, aliases []string) (CachedFile, error) {
+	for _, alias := range aliases {
+		contentHash, err := fileCache.index.FindAlias([]string{alias})
+		if err == nil && contentHash != cachedFile.ContentHash() {
+			log.Println("Not attaching", alias, "to", cachedFile.ContentHash(), "because it refers to", contentHash)
+			return nil, ErrorAliasConflict
+		}
+		contentHash, err = fileCache.index.FindUrl(alias)
+		if err == nil {
+			log.Println("Not attaching", alias, "to", cachedFile.ContentHash(), "because it is the url of", contentHash)
+			return nil, ErrorAliasConflict
+		}
+	}
+	if containsAll(cachedFile.Aliases(), aliases) {
+		return cachedFile, nil
+	}
+	err := fileCache.index.Merge(cachedFile, aliases, []string{})
+	if err != nil {
+		log.Println(err)
+		return nil, ErrorStorageFailed
+	}
+	indexedFile, err := fileCache.index.Get(cachedFile.ContentHash())
+	if err != nil {
+		return cachedFile, nil
+	}
+	return indexedFile, nil
+}
+
+// reapListeners removes listeners that have waited longer than the listener
+// timeout so that they do not accumulate when downloads never complete.
+func (fileCache *diskFileCache) reapListeners() {
+	reaped := fileCache.downloadListeners.Reap(fileCache.listenerTimeout, ErrorDownloadTimeout)
+	if reaped > 0 {
+		log.Println("Reaped", reaped, "download listeners")
+		fileCache.reapedCounter.Inc(int64(reaped))
+		fileCache.updateDownloadMetrics()
+	}
+}
+
+func (fileCache *diskFileCache) updateDownloadMetrics() {
+	fileCache.inTransitGauge.Update(int64(fileCache.downloadPool.InTransit()))
+	fileCache.queuedGauge.Update(int64(fileCache.workers.Queued()))
+	fileCache.runningGauge.Update(int64(fileCache.workers.Running()))
+	fileCache.waitersGauge.Update(int64(fileCache.downloadListeners.Count()))
 }
 
 func (fileCache *diskFileCache) handleEviction(evicted *Item) {
@@ -3,16 +3,72 @@ package app
 import (
 	"github.com/ngerakines/codederror"
 	"log"
+	"strings"
 )
 
 var (
-	ErrorNotImplemented = codederror.NewCodedError([]string{"TRM", "APP"}, 1, "Something wasn't implemented")
+	ErrorNotImplemented      = codederror.NewCodedError([]string{"TRM", "APP"}, 1, "Something wasn't implemented")
+	ErrorInvalidRequest      = codederror.NewCodedError([]string{"TRM", "API"}, 1, "The request body could not be parsed")
+	ErrorMissingUrl          = codederror.NewCodedError([]string{"TRM", "API"}, 2, "The url parameter is required")
+	ErrorInvalidUrl          = codederror.NewCodedError([]string{"TRM", "API"}, 3, "The url must be an absolute http or https url")
+	ErrorBatchTooLarge       = codederror.NewCodedError([]string{"TRM", "API"}, 4, "The batch contains too many entries")
+	ErrorInvalidAlias        = codederror.NewCodedError([]string{"TRM", "API"}, 5, "One or more aliases do not match the alias pattern")
+	ErrorUnauthorized        = codederror.NewCodedError([]string{"TRM", "API"}, 6, "A valid api token is required")
+	ErrorContentNotFound     = codederror.NewCodedError([]string{"TRM", "API"}, 7, "No content was found for the url, alias or content hash")
+	ErrorInvalidQuery        = codederror.NewCodedError([]string{"TRM", "API"}, 8, "One or more query parameters are invalid")
+	ErrorOriginNotAllowed    = codederror.NewCodedError([]string{"TRM", "API"}, 9, "The url or the address it resolves to is not allowed")
+	ErrorInvalidDigest       = codederror.NewCodedError([]string{"TRM", "API"}, 10, "The digest must be sha1, sha256 or sha512 followed by = and a hex encoded digest")
+	ErrorAliasConflict       = codederror.NewCodedError([]string{"TRM", "API"}, 11, "One or more aliases already refer to other content")
+	ErrorAmbiguousQuery      = codederror.NewCodedError([]string{"TRM", "API"}, 12, "Only one of the url, alias or hash parameters can be given")
+	ErrorPurgeFailed         = codederror.NewCodedError([]string{"TRM", "APP"}, 2, "The content could not be removed from the cache")
+	ErrorIndexUnavailable    = codederror.NewCodedError([]string{"TRM", "APP"}, 3, "The index could not be read")
+	ErrorDownloadTimeout     = codederror.NewCodedError([]string{"TRM", "APP"}, 4, "The download did not complete in time")
+	ErrorUpstreamStatus      = codederror.NewCodedError([]string{"TRM", "APP"}, 5, "The origin returned a status that cannot be cached")
+	ErrorUpstreamUnavailable = codederror.NewCodedError([]string{"TRM", "APP"}, 6, "The origin could not be reached")
+	ErrorUpstreamTimeout     = codederror.NewCodedError([]string{"TRM", "APP"}, 7, "The origin did not respond in time")
+	ErrorStorageFailed       = codederror.NewCodedError([]string{"TRM", "APP"}, 8, "The content could not be stored")
+	ErrorObjectTooLarge      = codederror.NewCodedError([]string{"TRM", "APP"}, 9, "The content is larger than the maximum size allowed")
+	ErrorQueueFull           = codederror.NewCodedError([]string{"TRM", "APP"}, 10, "Too many downloads are queued")
+	ErrorChecksumMismatch    = codederror.NewCodedError([]string{"TRM", "APP"}, 11, "The content does not match the expected digest")
+	ErrorDigestUnavailable   = codederror.NewCodedError([]string{"TRM", "APP"}, 12, "The content was stored without a digest for the expected algorithm and cannot be verified")
 
 	AllErrors = []codederror.CodedError{
 		ErrorNotImplemented,
+		ErrorInvalidRequest,
+		ErrorMissingUrl,
+		ErrorInvalidUrl,
+		ErrorBatchTooLarge,
+		ErrorInvalidAlias,
+		ErrorUnauthorized,
+		ErrorContentNotFound,
+		ErrorInvalidQuery,
+		ErrorOriginNotAllowed,
+		ErrorInvalidDigest,
+		ErrorAliasConflict,
+		ErrorAmbiguousQuery,
+		ErrorPurgeFailed,
+		ErrorIndexUnavailable,
+		ErrorDownloadTimeout,
+		ErrorUpstreamStatus,
+		ErrorUpstreamUnavailable,
+		ErrorUpstreamTimeout,
+		ErrorStorageFailed,
+		ErrorObjectTooLarge,
+		ErrorQueueFull,
+		ErrorChecksumMismatch,
+		ErrorDigestUnavailable,
 	}
 )
 
+// isCodedError returns true if the error is the given coded error.
+func isCodedError(err error, codedError codederror.CodedError) bool {
+	other, ok := err.(codederror.CodedError)
+	if !ok || other.Code() != codedError.Code() {
+		return false
+	}
+	return strings.Join(other.Namespaces(), ".") == strings.Join(codedError.Namespaces(), ".")
+}
+
 // DumpErrors prints out all of the errors contained in AllErrors.
 func DumpErrors() {
 	for _, err := range AllErrors {
@@ -8,19 +8,52 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Index interface {
-	Find(terms []string) (string, error)
+	FindUrl(url string) (string, error)
+	FindAlias(aliases []string) (string, error)
+	Get(contentHash string) (CachedFile, error)
 	Update(cachedFile CachedFile) error
 	Merge(cachedFile CachedFile, aliases, urls []string) error
+	Detach(contentHash string, urls []string) error
 	Clear(id string) error
+	List(query IndexQuery) ([]CachedFile, int, error)
 }
 
+// IndexQuery describes which cached files are returned by Index.List and in
+// what order. Zero values are not used to filter cached files.
+type IndexQuery struct {
+	UrlPrefix     string
+	AliasPrefix   string
+	MinSize       int
+	MaxSize       int
+	FetchedBefore time.Time
+	FetchedAfter  time.Time
+	Sort          string
+	Offset        int
+	Limit         int
+}
+
+// IndexSortOrders contains the sort orders supported by Index.List. A leading
+// "-" reverses the order.
+var IndexSortOrders = []string{"hash", "-hash", "size", "-size", "fetched", "-fetched"}
+
 type localIndex struct {
+	mu   sync.RWMutex
 	path string
 
+	// urls and aliases are kept apart so that an alias can never be used to
+	// find the content of a url.
+	urls    map[string]string
 	aliases map[string]string
+	// records holds a copy of every indexed record so that listing does not
+	// read the whole index from disk.
+	records map[string]CachedFile
 }
 
 func newLocalIndex(path string) Index {
@@ -32,7 +65,9 @@ func newLocalIndex(path string) Index {
 		panic(err)
 	}
 
+	index.urls = make(map[string]string)
 	index.aliases = make(map[string]string)
+	index.records = make(map[string]CachedFile)
 	index.init()
 	return index
 }
@@ -54,11 +89,12 @@ func (index *localIndex) init() {
 		_, file := filepath.Split(path)
 		data, err := index.load(file)
 		if err == nil {
+			index.records[data.ContentHash()] = data
 			for _, alias := range data.Aliases() {
 				index.aliases[alias] = data.ContentHash()
 			}
 			for _, url := range data.Urls() {
-				index.aliases[url] = data.ContentHash()
+				index.urls[url] = data.ContentHash()
 			}
 		}
 		return nil
@@ -69,8 +105,27 @@ func (index *localIndex) init() {
 	}
 }
 
+// Update writes the cached file to the index. The urls and aliases of an
+// existing record are kept, so content downloaded again from another url is
+// not detached from the urls and aliases it already has.
 func (index *localIndex) Update(cachedFile CachedFile) error {
-	err := index.write(cachedFile)
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	indexedFile, err := index.load(cachedFile.ContentHash())
+	if err == nil {
+		updatedFile := new(simpleCachedFile)
+		updatedFile.InternalContentHash = cachedFile.ContentHash()
+		updatedFile.InternalUrls = union(indexedFile.Urls(), cachedFile.Urls())
+		updatedFile.InternalAliases = union(indexedFile.Aliases(), cachedFile.Aliases())
+		updatedFile.InternalSize = cachedFile.Size()
+		updatedFile.InternalAttributes = cachedFile.Attributes()
+		updatedFile.InternalFetched = cachedFile.Fetched()
+		updatedFile.InternalHashAlgorithm = cachedFile.HashAlgorithm()
+		cachedFile = updatedFile
+	}
+
+	err = index.write(cachedFile)
 	if err != nil {
 		return err
 	}
@@ -78,36 +133,35 @@ func (index *localIndex) Update(cachedFile CachedFile) error {
 		index.aliases[alias] = cachedFile.ContentHash()
 	}
 	for _, url := range cachedFile.Urls() {
-		index.aliases[url] = cachedFile.ContentHash()
+		index.urls[url] = cachedFile.ContentHash()
 	}
 	return nil
 }
 
 func (index *localIndex) Merge(cachedFile CachedFile, aliases, urls []string) error {
-	allAliases := make([]string, 0, 0)
-	for _, alias := range cachedFile.Aliases() {
-		allAliases = append(allAliases, alias)
-	}
-	for _, alias := range aliases {
-		allAliases = append(allAliases, alias)
-	}
+	index.mu.Lock()
+	defer index.mu.Unlock()
 
-	allUrls := make([]string, 0, 0)
-	for _, url := range cachedFile.Urls() {
-		allUrls = append(allUrls, url)
-	}
-	for _, url := range urls {
-		allUrls = append(allUrls, url)
+	// The indexed record is merged rather than the given cached file because
+	// it may already have had other urls and aliases merged into it.
+	indexedFile, err := index.load(cachedFile.ContentHash())
+	if err == nil {
+		cachedFile = indexedFile
 	}
 
+	allAliases := union(cachedFile.Aliases(), aliases)
+	allUrls := union(cachedFile.Urls(), urls)
+
 	newCachedFile := new(simpleCachedFile)
 	newCachedFile.InternalContentHash = cachedFile.ContentHash()
 	newCachedFile.InternalUrls = allUrls
 	newCachedFile.InternalAliases = allAliases
 	newCachedFile.InternalSize = cachedFile.Size()
 	newCachedFile.InternalAttributes = cachedFile.Attributes()
+	newCachedFile.InternalFetched = cachedFile.Fetched()
+	newCachedFile.InternalHashAlgorithm = cachedFile.HashAlgorithm()
 
-	err := index.write(newCachedFile)
+	err = index.write(newCachedFile)
 	if err != nil {
 		return err
 	}
@@ -115,40 +169,139 @@ func (index *localIndex) Merge(cachedFile CachedFile, aliases, urls []string) er
 		index.aliases[alias] = cachedFile.ContentHash()
 	}
 	for _, url := range allUrls {
-		index.aliases[url] = cachedFile.ContentHash()
+		index.urls[url] = cachedFile.ContentHash()
 	}
 	return nil
 }
 
+// Detach removes the urls from the cached file so that they can point to
+// other content. Urls that already point to other content are left as they
+// are.
+func (index *localIndex) Detach(contentHash string, urls []string) error {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	cachedFile, err := index.load(contentHash)
+	if err != nil {
+		return err
+	}
+
+	remainingUrls := make([]string, 0, 0)
+	for _, url := range cachedFile.Urls() {
+		if !contains(urls, url) {
+			remainingUrls = append(remainingUrls, url)
+		}
+	}
+	for _, url := range urls {
+		if index.urls[url] == contentHash {
+			delete(index.urls, url)
+		}
+	}
+
+	detachedFile := new(simpleCachedFile)
+	detachedFile.InternalContentHash = cachedFile.ContentHash()
+	detachedFile.InternalUrls = remainingUrls
+	detachedFile.InternalAliases = cachedFile.Aliases()
+	detachedFile.InternalSize = cachedFile.Size()
+	detachedFile.InternalAttributes = cachedFile.Attributes()
+	detachedFile.InternalFetched = cachedFile.Fetched()
+	detachedFile.InternalHashAlgorithm = cachedFile.HashAlgorithm()
+	return index.write(detachedFile)
+}
+
 func (index *localIndex) Clear(contentHash string) error {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
 	cachedFile, err := index.load(contentHash)
 	if err != nil {
 		return err
 	}
 
+	// Urls and aliases that have since been moved to other content are
+	// left as they are.
 	for _, alias := range cachedFile.Aliases() {
-		delete(index.aliases, alias)
+		if index.aliases[alias] == contentHash {
+			delete(index.aliases, alias)
+		}
 	}
 	for _, url := range cachedFile.Urls() {
-		delete(index.aliases, url)
+		if index.urls[url] == contentHash {
+			delete(index.urls, url)
+		}
 	}
 
+	delete(index.records, contentHash)
+
 	location := index.indexPath(contentHash)
 
 	err = os.RemoveAll(location)
 	return err
 }
 
-func (index *localIndex) Find(terms []string) (string, error) {
-	for _, term := range terms {
-		contentHash, hasContentHash := index.aliases[term]
+// FindUrl returns the content hash of the content downloaded from the url.
+// Aliases are never consulted.
+func (index *localIndex) FindUrl(url string) (string, error) {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	contentHash, hasContentHash := index.urls[url]
+	if hasContentHash {
+		log.Println("Found content", contentHash, "for url", url)
+		return contentHash, nil
+	}
+	log.Println("No content has found for url", url)
+	return "", errors.New("No content hash found for url")
+}
+
+// FindAlias returns the content hash of the content that the first known
+// alias refers to.
+func (index *localIndex) FindAlias(aliases []string) (string, error) {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	for _, alias := range aliases {
+		contentHash, hasContentHash := index.aliases[alias]
 		if hasContentHash {
-			log.Println("Found content", contentHash, "for terms", terms)
+			log.Println("Found content", contentHash, "for aliases", aliases)
 			return contentHash, nil
 		}
 	}
-	log.Println("No content has found for terms", terms)
-	return "", errors.New("No content hash found for term")
+	log.Println("No content has found for aliases", aliases)
+	return "", errors.New("No content hash found for alias")
+}
+
+// Get returns the cached file for the content hash if it has been indexed.
+func (index *localIndex) Get(contentHash string) (CachedFile, error) {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	return index.load(contentHash)
+}
+
+// List returns a page of the cached files that match the query along with the
+// total number of cached files that match.
+func (index *localIndex) List(query IndexQuery) ([]CachedFile, int, error) {
+	index.mu.RLock()
+	matches := make([]CachedFile, 0, 0)
+	for _, cachedFile := range index.records {
+		if query.matches(cachedFile) {
+			matches = append(matches, cachedFile)
+		}
+	}
+	index.mu.RUnlock()
+
+	sort.Sort(cachedFileSorter{matches, query.Sort})
+
+	total := len(matches)
+	if query.Offset >= total {
+		return []CachedFile{}, total, nil
+	}
+	end := total
+	if query.Limit > 0 && query.Offset+query.Limit < total {
+		end = query.Offset + query.Limit
+	}
+	return matches[query.Offset:end], total, nil
 }
 
 func (index *localIndex) write(cachedFile CachedFile) error {
@@ -160,7 +313,19 @@ func (index *localIndex) write(cachedFile CachedFile) error {
 	}
 
 	err = ioutil.WriteFile(location, data, 00777)
-	return err
+	if err != nil {
+		return err
+	}
+
+	// The record is decoded from what was written so that it is not shared
+	// with the caller.
+	var record simpleCachedFile
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		return err
+	}
+	index.records[record.ContentHash()] = &record
+	return nil
 }
 
 func (index *localIndex) load(contentHash string) (CachedFile, error) {
@@ -182,3 +347,94 @@ func (index *localIndex) load(contentHash string) (CachedFile, error) {
 func (index *localIndex) indexPath(id string) string {
 	return filepath.Join(index.path, id)
 }
+
+func (query IndexQuery) matches(cachedFile CachedFile) bool {
+	if query.UrlPrefix != "" && !hasPrefix(cachedFile.Urls(), query.UrlPrefix) {
+		return false
+	}
+	if query.AliasPrefix != "" && !hasPrefix(cachedFile.Aliases(), query.AliasPrefix) {
+		return false
+	}
+	if query.MinSize > 0 && cachedFile.Size() < query.MinSize {
+		return false
+	}
+	if query.MaxSize > 0 && cachedFile.Size() > query.MaxSize {
+		return false
+	}
+	if !query.FetchedBefore.IsZero() && !cachedFile.Fetched().Before(query.FetchedBefore) {
+		return false
+	}
+	if !query.FetchedAfter.IsZero() && !cachedFile.Fetched().After(query.FetchedAfter) {
+		return false
+	}
+	return true
+}
+
+func hasPrefix(values []string, prefix string) bool {
+	for _, value := range values {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type cachedFileSorter struct {
+	cachedFiles []CachedFile
+	order       string
+}
+
+func (sorter cachedFileSorter) Len() int {
+	return len(sorter.cachedFiles)
+}
+
+func (sorter cachedFileSorter) Swap(i, j int) {
+	sorter.cachedFiles[i], sorter.cachedFiles[j] = sorter.cachedFiles[j], sorter.cachedFiles[i]
+}
+
+func (sorter cachedFileSorter) Less(i, j int) bool {
+	a, b := sorter.cachedFiles[i], sorter.cachedFiles[j]
+	if strings.HasPrefix(sorter.order, "-") {
+		a, b = b, a
+	}
+	switch strings.TrimPrefix(sorter.order, "-") {
+	case "size":
+		if a.Size() != b.Size() {
+			return a.Size() < b.Size()
+		}
+	case "fetched":
+		if !a.Fetched().Equal(b.Fetched()) {
+			return a.Fetched().Before(b.Fetched())
+		}
+	}
+	return a.ContentHash() < b.ContentHash()
+}
+
+func contains(values []string, value string) bool {
+	for _, existing := range values {
+		if existing == value {
+			return true
+		}
+	}
+	return false
+}
+
+// union returns the distinct values of both, in the order they were given.
+func union(values, others []string) []string {
+	results := make([]string, 0, len(values)+len(others))
+	for _, value := range append(append([]string{}, values...), others...) {
+		if !contains(results, value) {
+			results = append(results, value)
+		}
+	}
+	return results
+}
+
+func containsAll(values, others []string) bool {
+	for _, other := range others {
+		if !contains(values, other) {
+			return false
+		}
+	}
+	return true
+}
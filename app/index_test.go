@@ -0,0 +1,142 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestCachedFile(contentHash, url, alias string, size int, fetched time.Time) CachedFile {
+	cachedFile := new(simpleCachedFile)
+	cachedFile.InternalContentHash = contentHash
+	cachedFile.InternalUrls = []string{url}
+	cachedFile.InternalAliases = []string{alias}
+	cachedFile.InternalSize = size
+	cachedFile.InternalAttributes = map[string]string{}
+	cachedFile.InternalFetched = fetched
+	return cachedFile
+}
+
+func TestLocalIndexList(t *testing.T) {
+	path, err := ioutil.TempDir("", "tram-index")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(path)
+
+	now := time.Now().UTC()
+	index := newLocalIndex(path)
+	index.Update(newTestCachedFile("aaaa", "http://a.example.com/1", "a-1", 30, now.Add(-3*time.Hour)))
+	index.Update(newTestCachedFile("bbbb", "http://a.example.com/2", "a-2", 10, now.Add(-2*time.Hour)))
+	index.Update(newTestCachedFile("cccc", "http://b.example.com/1", "b-1", 20, now.Add(-1*time.Hour)))
+
+	tests := []struct {
+		query    IndexQuery
+		expected []string
+		total    int
+	}{
+		{IndexQuery{Sort: "hash"}, []string{"aaaa", "bbbb", "cccc"}, 3},
+		{IndexQuery{Sort: "-hash"}, []string{"cccc", "bbbb", "aaaa"}, 3},
+		{IndexQuery{Sort: "size"}, []string{"bbbb", "cccc", "aaaa"}, 3},
+		{IndexQuery{Sort: "-fetched"}, []string{"cccc", "bbbb", "aaaa"}, 3},
+		{IndexQuery{Sort: "hash", UrlPrefix: "http://a.example.com/"}, []string{"aaaa", "bbbb"}, 2},
+		{IndexQuery{Sort: "hash", AliasPrefix: "b-"}, []string{"cccc"}, 1},
+		{IndexQuery{Sort: "hash", MinSize: 15, MaxSize: 25}, []string{"cccc"}, 1},
+		{IndexQuery{Sort: "hash", FetchedBefore: now.Add(-90 * time.Minute)}, []string{"aaaa", "bbbb"}, 2},
+		{IndexQuery{Sort: "hash", FetchedAfter: now.Add(-150 * time.Minute)}, []string{"bbbb", "cccc"}, 2},
+		{IndexQuery{Sort: "hash", Offset: 1, Limit: 1}, []string{"bbbb"}, 3},
+		{IndexQuery{Sort: "hash", Offset: 2, Limit: 5}, []string{"cccc"}, 3},
+		{IndexQuery{Sort: "hash", Offset: 3, Limit: 1}, []string{}, 3},
+	}
+	for _, test := range tests {
+		cachedFiles, total, err := index.List(test.query)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		contentHashes := make([]string, 0, len(cachedFiles))
+		for _, cachedFile := range cachedFiles {
+			contentHashes = append(contentHashes, cachedFile.ContentHash())
+		}
+		if total != test.total || !equalStrings(contentHashes, test.expected) {
+			t.Error("Unexpected entries", contentHashes, total, "for", test.query)
+		}
+	}
+
+	index.Clear("bbbb")
+	_, total, _ := index.List(IndexQuery{Sort: "hash"})
+	if total != 2 {
+		t.Error("Expected cleared entries not to be listed but found", total)
+	}
+	_, total, _ = newLocalIndex(path).List(IndexQuery{Sort: "hash"})
+	if total != 2 {
+		t.Error("Expected the entries to be listed when the index is reloaded but found", total)
+	}
+}
+
+func TestLocalIndexFind(t *testing.T) {
+	path, err := ioutil.TempDir("", "tram-index")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(path)
+
+	index := newLocalIndex(path)
+	index.Update(newTestCachedFile("aaaa", "http://a.example.com/1", "a-1", 10, time.Now()))
+	index.Update(newTestCachedFile("bbbb", "http://b.example.com/1", "http://a.example.com/2", 10, time.Now()))
+
+	for _, reloaded := range []Index{index, newLocalIndex(path)} {
+		if contentHash, err := reloaded.FindUrl("http://a.example.com/1"); err != nil || contentHash != "aaaa" {
+			t.Error("Expected the url to be found but found", contentHash, err)
+		}
+		if contentHash, err := reloaded.FindAlias([]string{"missing", "a-1"}); err != nil || contentHash != "aaaa" {
+			t.Error("Expected the alias to be found but found", contentHash, err)
+		}
+		if contentHash, err := reloaded.FindUrl("http://a.example.com/2"); err == nil {
+			t.Error("Expected an alias not to be found as a url but found", contentHash)
+		}
+		if contentHash, err := reloaded.FindAlias([]string{"http://a.example.com/1"}); err == nil {
+			t.Error("Expected a url not to be found as an alias but found", contentHash)
+		}
+	}
+}
+
+func TestLocalIndexUpdateKeepsUrlsAndAliases(t *testing.T) {
+	path, err := ioutil.TempDir("", "tram-index")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(path)
+
+	index := newLocalIndex(path)
+	index.Update(newTestCachedFile("aaaa", "http://a.example.com/1", "a-1", 10, time.Now()))
+	index.Update(newTestCachedFile("aaaa", "http://a.example.com/2", "a-2", 10, time.Now()))
+
+	cachedFile, err := index.Get("aaaa")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !equalStrings(cachedFile.Urls(), []string{"http://a.example.com/1", "http://a.example.com/2"}) || !equalStrings(cachedFile.Aliases(), []string{"a-1", "a-2"}) {
+		t.Error("Expected the urls and aliases to be kept but found", cachedFile.Urls(), cachedFile.Aliases())
+	}
+
+	index.Clear("aaaa")
+	if _, err := index.FindAlias([]string{"a-1", "a-2"}); err == nil {
+		t.Error("Expected the aliases to be cleared")
+	}
+	if _, err := index.FindUrl("http://a.example.com/1"); err == nil {
+		t.Error("Expected the urls to be cleared")
+	}
+}
+
+func equalStrings(values, others []string) bool {
+	if len(values) != len(others) {
+		return false
+	}
+	for i := range values {
+		if values[i] != others[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -16,7 +16,15 @@ type DownloadListener struct {
 	when    time.Time
 	url     string
 	aliases []string
-	channel chan CachedFile
+	digest  *util.Digest
+	channel chan downloadResult
+}
+
+// downloadResult is sent to download listeners when a download completes,
+// either with the cached file or with the error that caused it to fail.
+type downloadResult struct {
+	cachedFile CachedFile
+	err        error
 }
 
 func NewDownloadListeners() *DownloadListeners {
@@ -27,40 +35,154 @@ func NewDownloadListeners() *DownloadListeners {
 	return downloadListeners
 }
 
-func (downloadListeners *DownloadListeners) Add(url string, aliases []string, channel chan CachedFile) {
-	downloadListener := DownloadListener{when: time.Now(), url: url, aliases: aliases, channel: channel}
+func (downloadListeners *DownloadListeners) Add(url string, aliases []string, digest *util.Digest, channel chan downloadResult) {
+	downloadListener := DownloadListener{when: time.Now(), url: url, aliases: aliases, digest: digest, channel: channel}
 	downloadListeners.mu.Lock()
 	downloadListeners.listeners[downloadListeners.um.GenerateHex()] = downloadListener
 	downloadListeners.mu.Unlock()
 }
 
-func (downloadListeners *DownloadListeners) Notify(cachedFile CachedFile) {
+// Notify sends the cached file to the listeners waiting on any of its urls.
+// Listeners expecting a digest that the cached file does not match are sent
+// an error instead. The aliases of the other listeners are attached with the
+// attach function, which returns the cached file to send or an error.
+func (downloadListeners *DownloadListeners) Notify(cachedFile CachedFile, attach func(cachedFile CachedFile, aliases []string) (CachedFile, error)) {
+	downloadListeners.notify(cachedFile.Urls(), func(downloadListener DownloadListener) downloadResult {
+		err := verifyDigest(cachedFile, downloadListener.digest)
+		if err != nil {
+			return downloadResult{nil, err}
+		}
+		attachedFile, err := attach(cachedFile, downloadListener.aliases)
+		if err != nil {
+			return downloadResult{nil, err}
+		}
+		return downloadResult{attachedFile, nil}
+	})
+}
+
+// NotifyError sends the error to the listeners waiting on the url of a
+// download that failed.
+func (downloadListeners *DownloadListeners) NotifyError(url string, err error) {
+	downloadListeners.notify([]string{url}, func(DownloadListener) downloadResult {
+		return downloadResult{nil, err}
+	})
+}
+
+// NotifyMismatch sends ErrorChecksumMismatch to the listeners waiting on the
+// url that expect a digest other than the digests of the discarded content.
+// It returns true if other listeners are still waiting on the url.
+func (downloadListeners *DownloadListeners) NotifyMismatch(url string, digests map[string]string) bool {
 	downloadListeners.mu.Lock()
-	toRemove := make([]string, 0, 0)
+	defer downloadListeners.mu.Unlock()
+	waiting := false
 	for key, downloadListener := range downloadListeners.listeners {
-		if shouldNotify(cachedFile, downloadListener) {
-			downloadListener.channel <- cachedFile
-			toRemove = append(toRemove, key)
+		if !shouldNotify([]string{url}, downloadListener) {
+			continue
+		}
+		if downloadListener.digest != nil && !matchesDigest(digests, downloadListener.digest) {
+			sendResult(downloadListener.channel, downloadResult{nil, ErrorChecksumMismatch})
+			delete(downloadListeners.listeners, key)
+		} else {
+			waiting = true
 		}
 	}
-	for _, key := range toRemove {
-		delete(downloadListeners.listeners, key)
+	return waiting
+}
+
+// Digests returns the digests expected by the listeners waiting on the url.
+func (downloadListeners *DownloadListeners) Digests(url string) []*util.Digest {
+	downloadListeners.mu.Lock()
+	defer downloadListeners.mu.Unlock()
+	digests := make([]*util.Digest, 0, 0)
+	for _, downloadListener := range downloadListeners.listeners {
+		if downloadListener.digest != nil && shouldNotify([]string{url}, downloadListener) {
+			digests = append(digests, downloadListener.digest)
+		}
 	}
-	downloadListeners.mu.Unlock()
+	return digests
 }
 
-func shouldNotify(cachedFile CachedFile, downloadListener DownloadListener) bool {
-	for _, url := range cachedFile.Urls() {
-		if downloadListener.url == url {
+// Remove removes the listeners that send to the channel, returning true if
+// any were removed.
+func (downloadListeners *DownloadListeners) Remove(channel chan downloadResult) bool {
+	downloadListeners.mu.Lock()
+	defer downloadListeners.mu.Unlock()
+	removed := false
+	for key, downloadListener := range downloadListeners.listeners {
+		if downloadListener.channel == channel {
+			delete(downloadListeners.listeners, key)
+			removed = true
+		}
+	}
+	return removed
+}
+
+// Reap removes the listeners that have been waiting for longer than the
+// timeout, sending them the error. The number of listeners removed is
+// returned.
+func (downloadListeners *DownloadListeners) Reap(timeout time.Duration, err error) int {
+	downloadListeners.mu.Lock()
+	defer downloadListeners.mu.Unlock()
+	deadline := time.Now().Add(-timeout)
+	reaped := 0
+	for key, downloadListener := range downloadListeners.listeners {
+		if downloadListener.when.Before(deadline) {
+			sendResult(downloadListener.channel, downloadResult{nil, err})
+			delete(downloadListeners.listeners, key)
+			reaped++
+		}
+	}
+	return reaped
+}
+
+// Waiting returns true if any listener is waiting on the url.
+func (downloadListeners *DownloadListeners) Waiting(url string) bool {
+	downloadListeners.mu.Lock()
+	defer downloadListeners.mu.Unlock()
+	for _, downloadListener := range downloadListeners.listeners {
+		if shouldNotify([]string{url}, downloadListener) {
 			return true
 		}
 	}
-	// NKG: This can be improved.
-	for _, alias := range cachedFile.Aliases() {
-		for _, alias2 := range downloadListener.aliases {
-			if alias == alias2 {
-				return true
-			}
+	return false
+}
+
+// Count returns the number of listeners that are waiting.
+func (downloadListeners *DownloadListeners) Count() int {
+	downloadListeners.mu.Lock()
+	defer downloadListeners.mu.Unlock()
+	return len(downloadListeners.listeners)
+}
+
+// notify sends each of the listeners waiting on any of the urls the result
+// for that listener and removes them.
+func (downloadListeners *DownloadListeners) notify(urls []string, result func(DownloadListener) downloadResult) {
+	downloadListeners.mu.Lock()
+	defer downloadListeners.mu.Unlock()
+	for key, downloadListener := range downloadListeners.listeners {
+		if shouldNotify(urls, downloadListener) {
+			sendResult(downloadListener.channel, result(downloadListener))
+			delete(downloadListeners.listeners, key)
+		}
+	}
+}
+
+// sendResult sends the result without blocking. Listener channels are
+// buffered so that a result can be sent to a client that has stopped waiting.
+func sendResult(channel chan downloadResult, result downloadResult) {
+	select {
+	case channel <- result:
+	default:
+	}
+}
+
+// shouldNotify returns true if the listener is waiting on any of the urls.
+// Listeners are never matched by alias, because content downloaded for one
+// url must not be served for another url that shares an alias.
+func shouldNotify(urls []string, downloadListener DownloadListener) bool {
+	for _, url := range urls {
+		if downloadListener.url == url {
+			return true
 		}
 	}
 	return false
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ngerakines/tram/util"
+)
+
+func TestNotifyVerifiesEachListener(t *testing.T) {
+	cachedFile := newTestCachedFile("aaaa", "http://example.com/", "tram", 4, time.Now())
+	cachedFile.Attributes()[digestAttributePrefix+"sha256"] = strings.Repeat("a", 64)
+
+	downloadListeners := NewDownloadListeners()
+	matching := make(chan downloadResult, 1)
+	mismatched := make(chan downloadResult, 1)
+	unverified := make(chan downloadResult, 1)
+	other := make(chan downloadResult, 1)
+	downloadListeners.Add("http://example.com/", []string{"latest"}, &util.Digest{Algorithm: "sha256", Value: strings.Repeat("a", 64)}, matching)
+	downloadListeners.Add("http://example.com/", nil, &util.Digest{Algorithm: "sha256", Value: strings.Repeat("b", 64)}, mismatched)
+	downloadListeners.Add("http://example.com/", nil, nil, unverified)
+	downloadListeners.Add("http://example.com/other", []string{"latest"}, nil, other)
+
+	attached := make([]string, 0, 0)
+	downloadListeners.Notify(cachedFile, func(cachedFile CachedFile, aliases []string) (CachedFile, error) {
+		attached = append(attached, aliases...)
+		return cachedFile, nil
+	})
+
+	if result := <-matching; result.err != nil || result.cachedFile == nil {
+		t.Error("Expected the listener with a matching digest to be sent the cached file but got", result.err)
+	}
+	if result := <-mismatched; !isCodedError(result.err, ErrorChecksumMismatch) {
+		t.Error("Expected the listener with another digest to be sent a mismatch but got", result.err)
+	}
+	if result := <-unverified; result.err != nil || result.cachedFile == nil {
+		t.Error("Expected the listener without a digest to be sent the cached file but got", result.err)
+	}
+	if len(attached) != 1 || attached[0] != "latest" {
+		t.Error("Expected only the aliases of matching listeners to be attached but got", attached)
+	}
+	if len(other) != 0 || downloadListeners.Count() != 1 {
+		t.Error("Expected the listener sharing only an alias to keep waiting.")
+	}
+}
+
+func TestNotifyMismatch(t *testing.T) {
+	digests := map[string]string{"sha256": strings.Repeat("a", 64)}
+
+	downloadListeners := NewDownloadListeners()
+	matching := make(chan downloadResult, 1)
+	mismatched := make(chan downloadResult, 1)
+	unverified := make(chan downloadResult, 1)
+	downloadListeners.Add("http://example.com/", nil, &util.Digest{Algorithm: "sha256", Value: strings.Repeat("a", 64)}, matching)
+	downloadListeners.Add("http://example.com/", nil, &util.Digest{Algorithm: "sha1", Value: strings.Repeat("b", 40)}, mismatched)
+	downloadListeners.Add("http://example.com/", nil, nil, unverified)
+
+	if !downloadListeners.NotifyMismatch("http://example.com/", digests) {
+		t.Error("Expected listeners to still be waiting.")
+	}
+	if result := <-mismatched; !isCodedError(result.err, ErrorChecksumMismatch) {
+		t.Error("Expected the listener with another digest to be sent a mismatch but got", result.err)
+	}
+	if len(matching) != 0 || len(unverified) != 0 || downloadListeners.Count() != 2 {
+		t.Error("Expected the other listeners to keep waiting.")
+	}
+	if digests := downloadListeners.Digests("http://example.com/"); len(digests) != 1 || digests[0].Algorithm != "sha256" {
+		t.Error("Expected the digest of the matching listener but got", digests)
+	}
+	if downloadListeners.NotifyMismatch("http://example.com/other", digests) {
+		t.Error("Expected no listeners to be waiting on another url.")
+	}
+}
@@ -2,11 +2,12 @@ package app
 
 import (
 	"errors"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 type LocalStorageManager struct {
@@ -24,17 +25,21 @@ func newLocalStorageManager(basePath string) StorageManager {
 	return &LocalStorageManager{basePath}
 }
 
-func (storageManager *LocalStorageManager) Store(contentHash string, payload []byte, urls, aliases []string, callback chan CachedFile) {
-	path := filepath.Join(storageManager.basePath, contentHash)
+func (storageManager *LocalStorageManager) Store(spooledFile *SpooledFile, urls, aliases []string, attributes map[string]string) (CachedFile, error) {
+	path := filepath.Join(storageManager.basePath, spooledFile.ContentHash)
 
-	cachedFile := storageManager.newCachedFile(contentHash, urls, aliases, len(payload), path)
-	err := ioutil.WriteFile(path, payload, 00777)
+	err := os.Rename(spooledFile.Path, path)
 	if err != nil {
-		log.Println(err)
-		return
+		// The spool path may be on a different device than the storage path,
+		// in which case the spooled file is copied instead.
+		err = copyFile(spooledFile.Path, path)
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
 	}
 
-	callback <- cachedFile
+	return storageManager.newCachedFile(spooledFile.ContentHash, spooledFile.HashAlgorithm, urls, aliases, int(spooledFile.Size), path, attributes), nil
 }
 
 func (storageManager *LocalStorageManager) Delete(cachedFile CachedFile) error {
@@ -52,12 +57,50 @@ func (storageManager *LocalStorageManager) Serve(cachedFile CachedFile, res http
 		log.Println("Could not serve file because path attribute not set", cachedFile)
 		return errors.New("Invalid cached file.")
 	}
-	http.ServeFile(res, req, path)
+	file, err := os.Open(path)
+	if err != nil {
+		log.Println("Could not open cached file", path, err)
+		http.NotFound(res, req)
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		http.NotFound(res, req)
+		return err
+	}
+
+	setCachedFileHeaders(cachedFile, res.Header())
+	modTime := stat.ModTime()
+	lastModified, err := http.ParseTime(res.Header().Get("Last-Modified"))
+	if err == nil {
+		modTime = lastModified
+	}
+	http.ServeContent(res, req, "", modTime, file)
 	return nil
 }
 
-func (storageManager *LocalStorageManager) newCachedFile(contentHash string, urls, aliases []string, size int, path string) CachedFile {
-	attributes := make(map[string]string)
+func copyFile(source, destination string) error {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	destinationFile, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 00777)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(destinationFile, sourceFile)
+	if err != nil {
+		destinationFile.Close()
+		os.Remove(destination)
+		return err
+	}
+	return destinationFile.Close()
+}
+
+func (storageManager *LocalStorageManager) newCachedFile(contentHash, hashAlgorithm string, urls, aliases []string, size int, path string, attributes map[string]string) CachedFile {
 	attributes["path"] = path
 	cachedFile := new(simpleCachedFile)
 	cachedFile.InternalContentHash = contentHash
@@ -65,5 +108,7 @@ func (storageManager *LocalStorageManager) newCachedFile(contentHash string, url
 	cachedFile.InternalAliases = aliases
 	cachedFile.InternalSize = size
 	cachedFile.InternalAttributes = attributes
+	cachedFile.InternalFetched = time.Now()
+	cachedFile.InternalHashAlgorithm = hashAlgorithm
 	return cachedFile
 }
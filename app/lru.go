@@ -82,6 +82,18 @@ func (lru *LRUCache) Get(key string) (v Value, ok bool) {
 	return element.Value.(*entry).value, true
 }
 
+// Peek returns the value for the key without promoting it.
+func (lru *LRUCache) Peek(key string) (v Value, ok bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	element := lru.table[key]
+	if element == nil {
+		return nil, false
+	}
+	return element.Value.(*entry).value, true
+}
+
 func (lru *LRUCache) Set(key string, value Value) {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
@@ -93,6 +105,47 @@ func (lru *LRUCache) Set(key string, value Value) {
 	}
 }
 
+// Positions returns the positions of the keys that are in the cache, where 0
+// is the most recently used, without promoting them. The list is walked once
+// however many keys are given, stopping once all of them have been found.
+func (lru *LRUCache) Positions(keys []string) map[string]int {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	wanted := make(map[string]bool)
+	for _, key := range keys {
+		if lru.table[key] != nil {
+			wanted[key] = true
+		}
+	}
+	positions := make(map[string]int, len(wanted))
+	position := 0
+	for element := lru.list.Front(); element != nil && len(positions) < len(wanted); element = element.Next() {
+		key := element.Value.(*entry).key
+		if wanted[key] {
+			positions[key] = position
+		}
+		position++
+	}
+	return positions
+}
+
+// Delete removes the key from the cache without notifying eviction
+// listeners. It returns true if the key was in the cache.
+func (lru *LRUCache) Delete(key string) bool {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	element := lru.table[key]
+	if element == nil {
+		return false
+	}
+	lru.list.Remove(element)
+	delete(lru.table, key)
+	lru.size -= uint64(element.Value.(*entry).size)
+	return true
+}
+
 func (lru *LRUCache) updateInplace(element *list.Element, value Value) {
 	valueSize := value.Size()
 	sizeDiff := valueSize - element.Value.(*entry).size
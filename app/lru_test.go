@@ -0,0 +1,18 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCachePositions(t *testing.T) {
+	lru := NewLRUCache(100)
+	for _, key := range []string{"a", "b", "c"} {
+		lru.Set(key, newTestCachedFile(key, "", "", 1, time.Now()))
+	}
+	lru.Get("a")
+	positions := lru.Positions([]string{"a", "b", "missing"})
+	if len(positions) != 2 || positions["a"] != 0 || positions["b"] != 2 {
+		t.Error("Unexpected positions", positions)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"github.com/ngerakines/ketama"
 	"log"
 	"net/http"
+	"os"
+	"time"
 )
 
 type S3StorageManager struct {
@@ -30,27 +32,47 @@ func NewS3StorageManager(buckets []string, s3Client S3Client) StorageManager {
 	return &S3StorageManager{hashRing, s3Client}
 }
 
-func (storageManager *S3StorageManager) Store(contentHash string, payload []byte, urls, aliases []string, callback chan CachedFile) {
+func (storageManager *S3StorageManager) Store(spooledFile *SpooledFile, urls, aliases []string, attributes map[string]string) (CachedFile, error) {
+	contentHash := spooledFile.ContentHash
 	bucket := storageManager.bucketRing.Hash(contentHash)
 
-	contentObject, err := storageManager.s3Client.NewObject(contentHash, bucket, "application/octet-stream")
+	contentType, hasContentType := attributes[headerAttributePrefix+"Content-Type"]
+	if !hasContentType {
+		contentType = "application/octet-stream"
+	}
+	contentObject, err := storageManager.s3Client.NewObject(contentHash, bucket, contentType)
 	if err != nil {
 		log.Println(err.Error())
-		return
+		return nil, err
 	}
 
-	err = storageManager.s3Client.Put(contentObject, payload)
+	file, err := os.Open(spooledFile.Path)
 	if err != nil {
 		log.Println(err.Error())
-		return
+		return nil, err
 	}
+	defer file.Close()
 
-	cachedFile := storageManager.newCachedFile(contentHash, urls, aliases, len(payload), bucket)
+	err = storageManager.s3Client.Put(contentObject, file, spooledFile.Size)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
 
-	callback <- cachedFile
+	return storageManager.newCachedFile(contentHash, spooledFile.HashAlgorithm, urls, aliases, int(spooledFile.Size), bucket, attributes), nil
 }
 
 func (storageManager *S3StorageManager) Delete(cachedFile CachedFile) error {
+	bucket, hasBucket := cachedFile.Attributes()["bucket"]
+	if !hasBucket {
+		log.Println("Could not delete file because bucket attribute not set", cachedFile)
+		return errors.New("Invalid bucket attribute.")
+	}
+	err := storageManager.s3Client.Delete(bucket, cachedFile.ContentHash())
+	if err != nil {
+		log.Println(err)
+		return err
+	}
 	return nil
 }
 
@@ -60,6 +82,7 @@ func (storageManager *S3StorageManager) Serve(cachedFile CachedFile, res http.Re
 		log.Println("Could not serve file because bucket attribute not set", cachedFile)
 		return errors.New("Invalid bucket attribute.")
 	}
+	setCachedFileHeaders(cachedFile, res.Header())
 	err := storageManager.s3Client.Proxy(bucket, cachedFile.ContentHash(), res)
 	if err != nil {
 		log.Println(err)
@@ -68,8 +91,7 @@ func (storageManager *S3StorageManager) Serve(cachedFile CachedFile, res http.Re
 	return nil
 }
 
-func (storageManager *S3StorageManager) newCachedFile(contentHash string, urls, aliases []string, size int, bucket string) CachedFile {
-	attributes := make(map[string]string)
+func (storageManager *S3StorageManager) newCachedFile(contentHash, hashAlgorithm string, urls, aliases []string, size int, bucket string, attributes map[string]string) CachedFile {
 	attributes["bucket"] = bucket
 	cachedFile := new(simpleCachedFile)
 	cachedFile.InternalContentHash = contentHash
@@ -77,6 +99,8 @@ func (storageManager *S3StorageManager) newCachedFile(contentHash string, urls,
 	cachedFile.InternalAliases = aliases
 	cachedFile.InternalSize = size
 	cachedFile.InternalAttributes = attributes
+	cachedFile.InternalFetched = time.Now()
+	cachedFile.InternalHashAlgorithm = hashAlgorithm
 	return cachedFile
 }
 
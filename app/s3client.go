@@ -1,7 +1,6 @@
 package app
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"github.com/ngerakines/tram/util"
@@ -16,7 +15,7 @@ import (
 var onExitFlushLoop func()
 
 type S3Client interface {
-	Put(s3object S3Object, content []byte) error
+	Put(s3object S3Object, content io.Reader, size int64) error
 	Get(bucket, file string) (S3Object, error)
 	Proxy(bucket, file string, rw http.ResponseWriter) error
 	Delete(bucket, file string) error
@@ -34,6 +33,7 @@ type S3Object interface {
 type AmazonS3Client struct {
 	config        *AmazonS3ClientConfig
 	FlushInterval time.Duration
+	httpClient    *http.Client
 }
 
 type AmazonS3Object struct {
@@ -52,7 +52,7 @@ func NewBasicS3Config(key, secret, host string, verifySsl bool) *AmazonS3ClientC
 }
 
 func NewAmazonS3Client(config *AmazonS3ClientConfig) S3Client {
-	return &AmazonS3Client{config, 0}
+	return &AmazonS3Client{config, 0, util.NewHttpClient(config.verifySsl, 30*time.Second)}
 }
 
 func NewAmazonS3Object(name, bucket, contentType string) S3Object {
@@ -63,7 +63,7 @@ func NewAmazonS3ResponseObject(name, bucket, contentType string, content []byte)
 	return &AmazonS3Object{name, bucket, content, contentType}
 }
 
-func (client *AmazonS3Client) Put(s3object S3Object, content []byte) error {
+func (client *AmazonS3Client) Put(s3object S3Object, content io.Reader, size int64) error {
 	resource := fmt.Sprintf("/%s/%s", s3object.Bucket(), s3object.FileName())
 	date, signature := client.createSignature("PUT", s3object.ContentType(), resource)
 	headers := make(map[string]string)
@@ -75,7 +75,7 @@ func (client *AmazonS3Client) Put(s3object S3Object, content []byte) error {
 	}
 	url := fmt.Sprintf("%s/%s/%s", client.config.host, s3object.Bucket(), s3object.FileName())
 	log.Println("Publishing objec to", url)
-	_, err := client.submitPutRequest(url, content, headers)
+	_, err := client.submitPutRequest(url, content, size, headers)
 	if err != nil {
 		log.Println("error submitting put request:", err.Error())
 		return err
@@ -137,7 +137,7 @@ func (client *AmazonS3Client) createSignature(method, contentType, resource stri
 
 func (client *AmazonS3Client) submitGetRequest(url string, headers map[string]string) ([]byte, string, error) {
 	log.Println("url", url)
-	response, err := client.executeRequest("GET", url, nil, headers)
+	response, err := client.executeRequest("GET", url, nil, 0, headers)
 	if err != nil {
 		log.Println("response", response)
 		return nil, "", err
@@ -157,11 +157,12 @@ func (client *AmazonS3Client) submitGetRequest(url string, headers map[string]st
 
 func (client *AmazonS3Client) submitProxyGetRequest(url string, headers map[string]string, rw http.ResponseWriter) error {
 	log.Println("url", url)
-	response, err := client.executeRequest("GET", url, nil, headers)
+	response, err := client.executeRequest("GET", url, nil, 0, headers)
 	if err != nil {
 		log.Println("response", response)
 		return err
 	}
+	defer response.Body.Close()
 	if response.StatusCode == 404 {
 		return errors.New("Object not found")
 	}
@@ -170,8 +171,8 @@ func (client *AmazonS3Client) submitProxyGetRequest(url string, headers map[stri
 	return nil
 }
 
-func (client *AmazonS3Client) submitPutRequest(url string, payload []byte, headers map[string]string) ([]byte, error) {
-	response, err := client.executeRequest("PUT", url, bytes.NewReader(payload), headers)
+func (client *AmazonS3Client) submitPutRequest(url string, content io.Reader, size int64, headers map[string]string) ([]byte, error) {
+	response, err := client.executeRequest("PUT", url, content, size, headers)
 	if err != nil {
 		log.Println("error executing request", err)
 		return nil, err
@@ -186,11 +187,15 @@ func (client *AmazonS3Client) submitPutRequest(url string, payload []byte, heade
 }
 
 func (client *AmazonS3Client) submitDeleteRequest(url string, headers map[string]string) ([]byte, error) {
-	response, err := client.executeRequest("DELETE", url, nil, headers)
+	response, err := client.executeRequest("DELETE", url, nil, 0, headers)
 	if err != nil {
 		return nil, err
 	}
 	defer response.Body.Close()
+	// Objects that are already gone are treated as deleted.
+	if response.StatusCode >= 300 && response.StatusCode != 404 {
+		return nil, fmt.Errorf("Could not delete object: %s", response.Status)
+	}
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
 		return nil, err
@@ -198,18 +203,20 @@ func (client *AmazonS3Client) submitDeleteRequest(url string, headers map[string
 	return body, nil
 }
 
-func (client *AmazonS3Client) executeRequest(method, url string, body io.Reader, headers map[string]string) (*http.Response, error) {
+func (client *AmazonS3Client) executeRequest(method, url string, body io.Reader, contentLength int64, headers map[string]string) (*http.Response, error) {
 	log.Println("Preparing to send", method, "request to", url, "with ssl checking", !client.config.verifySsl)
-	httpClient := util.NewHttpClient(client.config.verifySsl, 30*time.Second)
 	request, err := http.NewRequest(method, url, body)
 	if err != nil {
 		log.Println("Error creating request", request)
 		return nil, err
 	}
+	if contentLength > 0 {
+		request.ContentLength = contentLength
+	}
 	for header, headerValue := range headers {
 		request.Header.Set(header, headerValue)
 	}
-	response, err := httpClient.Do(request)
+	response, err := client.httpClient.Do(request)
 	if err != nil {
 		log.Println("Error executing reqest", err)
 		return nil, err
@@ -1,9 +1,18 @@
 package app
 
 import (
+	"github.com/ngerakines/codederror"
+	"github.com/ngerakines/tram/config"
 	"github.com/ngerakines/tram/util"
+	"hash"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 type CachedFile interface {
@@ -12,32 +21,281 @@ type CachedFile interface {
 	Aliases() []string
 	Size() int
 	Attributes() map[string]string
+	Fetched() time.Time
+	HashAlgorithm() string
 }
 
 type StorageManager interface {
-	Store(contentHash string, payload []byte, urls, aliases []string, callback chan CachedFile)
+	Store(spooledFile *SpooledFile, urls, aliases []string, attributes map[string]string) (CachedFile, error)
 	Delete(cachedFile CachedFile) error
 	Serve(cachedFile CachedFile, res http.ResponseWriter, req *http.Request) error
 }
 
 type simpleCachedFile struct {
-	InternalContentHash string            `json:"ContentHash"`
-	InternalUrls        []string          `json:"Urls"`
-	InternalAliases     []string          `json:"Aliases"`
-	InternalSize        int               `json:"Size"`
-	InternalAttributes  map[string]string `json:"Attributes"`
+	InternalContentHash   string            `json:"ContentHash"`
+	InternalUrls          []string          `json:"Urls"`
+	InternalAliases       []string          `json:"Aliases"`
+	InternalSize          int               `json:"Size"`
+	InternalAttributes    map[string]string `json:"Attributes"`
+	InternalFetched       time.Time         `json:"Fetched"`
+	InternalHashAlgorithm string            `json:"HashAlgorithm,omitempty"`
 }
 
-func Download(downloader util.RemoteFileFetcher, storageManager StorageManager, url string, aliases []string, callback chan CachedFile) {
-	body, err := downloader(url)
+// SpooledFile is downloaded content that has been written to a temporary file
+// and hashed, but has not yet been committed to storage.
+type SpooledFile struct {
+	Path          string
+	ContentHash   string
+	HashAlgorithm string
+	Size          int64
+	Digests       map[string]string
+}
+
+// spoolFilePrefix is the prefix of the temporary files that downloads are
+// spooled to.
+const spoolFilePrefix = "tram-spool-"
+
+// headerAttributePrefix is prepended to the names of response headers that
+// are stored in cached file attributes.
+const headerAttributePrefix = "header:"
+
+// validatorAttributePrefix is prepended to the names of the response headers
+// that are sent back to the origin when the content is revalidated.
+const validatorAttributePrefix = "validator:"
+
+// validatedAttribute records when the content was last revalidated, including
+// attempts that failed because the origin could not be reached.
+const validatedAttribute = "validated"
+
+// digestAttributePrefix is prepended to the names of the digest algorithms
+// whose hex encoded digests are stored as attributes.
+const digestAttributePrefix = "digest:"
+
+// DefaultCachedHeaders are the response headers that are stored with cached
+// files when no headers are configured.
+var DefaultCachedHeaders = []string{"Content-Type", "Content-Disposition", "Last-Modified", "ETag"}
+
+// spool streams the source to a temporary file in the directory, hashing the
+// content with the hash algorithm as it is written, along with a digest for
+// each of the digest algorithms. Errors reading from the source are returned
+// as *util.FetchError, or as is if they are coded errors, so that they can be
+// told apart from storage errors.
+func spool(directory, url string, source io.Reader, hashAlgorithm string, algorithms []string) (*SpooledFile, error) {
+	writers := make([]io.Writer, 0, len(algorithms)+1)
+	digestHashers := make(map[string]hash.Hash)
+	for _, algorithm := range algorithms {
+		digestHasher, err := util.NewDigestHash(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		digestHashers[algorithm] = digestHasher
+		writers = append(writers, digestHasher)
+	}
+	// The content hash shares the digest hash of the same algorithm, if any.
+	hasher, hasHasher := digestHashers[hashAlgorithm]
+	if !hasHasher {
+		var err error
+		hasher, err = util.NewHash(hashAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+		writers = append(writers, hasher)
+	}
+
+	file, err := ioutil.TempFile(directory, spoolFilePrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := &readErrorReader{reader: source}
+	size, err := io.Copy(io.MultiWriter(append(writers, file)...), reader)
+	if err != nil {
+		os.Remove(file.Name())
+		if reader.err != nil {
+			if _, isCodedError := reader.err.(codederror.CodedError); isCodedError {
+				return nil, reader.err
+			}
+			return nil, &util.FetchError{Url: url, Err: reader.err}
+		}
+		return nil, err
+	}
+	err = file.Close()
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+	digests := make(map[string]string)
+	for algorithm, digestHasher := range digestHashers {
+		digests[algorithm] = util.HashSum(digestHasher)
+	}
+	return &SpooledFile{file.Name(), util.HashSum(hasher), hashAlgorithm, size, digests}, nil
+}
+
+// validatorAttributes returns the ETag and Last-Modified headers of the
+// response as attributes.
+func validatorAttributes(header http.Header) map[string]string {
+	attributes := make(map[string]string)
+	for _, name := range []string{"ETag", "Last-Modified"} {
+		value := header.Get(name)
+		if value != "" {
+			attributes[validatorAttributePrefix+name] = value
+		}
+	}
+	return attributes
+}
+
+// lastValidated returns when the cached file was last revalidated, or when
+// it was fetched if it has never been revalidated.
+func lastValidated(cachedFile CachedFile) time.Time {
+	validated, err := time.Parse(time.RFC3339, cachedFile.Attributes()[validatedAttribute])
+	if err != nil {
+		return cachedFile.Fetched()
+	}
+	return validated
+}
+
+// withAttributes returns a copy of the cached file with the attributes
+// replaced.
+func withAttributes(cachedFile CachedFile, attributes map[string]string) CachedFile {
+	copied := new(simpleCachedFile)
+	copied.InternalContentHash = cachedFile.ContentHash()
+	copied.InternalUrls = cachedFile.Urls()
+	copied.InternalAliases = cachedFile.Aliases()
+	copied.InternalSize = cachedFile.Size()
+	copied.InternalAttributes = attributes
+	copied.InternalFetched = cachedFile.Fetched()
+	copied.InternalHashAlgorithm = cachedFile.HashAlgorithm()
+	return copied
+}
+
+// digestAttributes returns the digests of the spooled file as attributes.
+func digestAttributes(spooledFile *SpooledFile) map[string]string {
+	attributes := make(map[string]string)
+	for algorithm, digest := range spooledFile.Digests {
+		attributes[digestAttributePrefix+algorithm] = digest
+	}
+	return attributes
+}
+
+// verifyDigest returns ErrorChecksumMismatch if the digest recorded for the
+// cached file does not match the expected digest. Digests that use the hash
+// algorithm of the cached file are checked against its content hash. Content
+// stored before digests were recorded has no digests for other algorithms, and
+// ErrorDigestUnavailable is returned because it cannot be verified.
+func verifyDigest(cachedFile CachedFile, expected *util.Digest) error {
+	if expected == nil {
+		return nil
+	}
+	recorded, hasRecorded := cachedFile.Attributes()[digestAttributePrefix+expected.Algorithm]
+	if !hasRecorded && expected.Algorithm == cachedFile.HashAlgorithm() {
+		recorded, hasRecorded = cachedFile.ContentHash(), true
+	}
+	if !hasRecorded {
+		log.Println("No", expected.Algorithm, "digest was recorded for", cachedFile.ContentHash(), "so it cannot be verified")
+		return ErrorDigestUnavailable
+	}
+	if recorded != expected.Value {
+		log.Println("Expected", expected.String(), "but", cachedFile.ContentHash(), "has", expected.Algorithm, recorded)
+		return ErrorChecksumMismatch
+	}
+	return nil
+}
+
+// matchesDigest returns true if the expected digest is one of the digests of
+// downloaded content.
+func matchesDigest(digests map[string]string, expected *util.Digest) bool {
+	return digests[expected.Algorithm] == expected.Value
+}
+
+// hashAlgorithm returns the algorithm that new content is addressed with.
+// Content already stored keeps the algorithm it was stored with.
+func hashAlgorithm(appConfig *config.AppConfig) string {
+	if appConfig.Storage.HashAlgorithm != "" {
+		return strings.ToLower(appConfig.Storage.HashAlgorithm)
+	}
+	return util.DefaultHashAlgorithm
+}
+
+// spoolPath returns the directory that downloads are spooled to. For local
+// storage it is within the storage directory so that spooled files can be
+// renamed into place.
+func spoolPath(appConfig *config.AppConfig) string {
+	if appConfig.Storage.SpoolPath != "" {
+		return appConfig.Storage.SpoolPath
+	}
+	if appConfig.Storage.Engine == "local" {
+		return filepath.Join(appConfig.Storage.BasePath, ".spool")
+	}
+	return os.TempDir()
+}
+
+// cleanSpoolPath removes spooled files left behind by downloads that did not
+// complete.
+func cleanSpoolPath(directory string) {
+	paths, err := filepath.Glob(filepath.Join(directory, spoolFilePrefix+"*"))
 	if err != nil {
-		log.Println(err.Error())
+		log.Println(err)
 		return
 	}
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// readErrorReader records the first error, other than io.EOF, returned by
+// the wrapped reader.
+type readErrorReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (reader *readErrorReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	if err != nil && err != io.EOF && reader.err == nil {
+		reader.err = err
+	}
+	return n, err
+}
 
-	contentHash := util.Hash(body)
+// maxSizeReader returns ErrorObjectTooLarge once more than the maximum number
+// of bytes have been read from the wrapped reader.
+type maxSizeReader struct {
+	reader    io.Reader
+	remaining int64
+}
 
-	storageManager.Store(contentHash, body, []string{url}, aliases, callback)
+func (reader *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	reader.remaining -= int64(n)
+	if reader.remaining < 0 {
+		return n, ErrorObjectTooLarge
+	}
+	return n, err
+}
+
+// headerAttributes returns the values of the allowed headers as cached file
+// attributes.
+func headerAttributes(header http.Header, allowed []string) map[string]string {
+	attributes := make(map[string]string)
+	for _, name := range allowed {
+		value := header.Get(name)
+		if value != "" {
+			attributes[headerAttributePrefix+http.CanonicalHeaderKey(name)] = value
+		}
+	}
+	return attributes
+}
+
+// setCachedFileHeaders sets the ETag of the cached file and replays the
+// response headers that were stored when the cached file was downloaded.
+func setCachedFileHeaders(cachedFile CachedFile, header http.Header) {
+	header.Set("ETag", "\""+cachedFile.ContentHash()+"\"")
+	for key, value := range cachedFile.Attributes() {
+		if strings.HasPrefix(key, headerAttributePrefix) {
+			header.Set(strings.TrimPrefix(key, headerAttributePrefix), value)
+		}
+	}
 }
 
 func (cachedFile *simpleCachedFile) ContentHash() string {
@@ -59,3 +317,16 @@ func (cachedFile *simpleCachedFile) Size() int {
 func (cachedFile *simpleCachedFile) Attributes() map[string]string {
 	return cachedFile.InternalAttributes
 }
+
+func (cachedFile *simpleCachedFile) Fetched() time.Time {
+	return cachedFile.InternalFetched
+}
+
+// HashAlgorithm returns the algorithm of the content hash. Content stored
+// before the algorithm was recorded is addressed by its sha1 hash.
+func (cachedFile *simpleCachedFile) HashAlgorithm() string {
+	if cachedFile.InternalHashAlgorithm == "" {
+		return util.LegacyHashAlgorithm
+	}
+	return cachedFile.InternalHashAlgorithm
+}
@@ -0,0 +1,72 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ngerakines/codederror"
+	"github.com/ngerakines/tram/util"
+)
+
+func testHash(t *testing.T, algorithm, content string) string {
+	hasher, err := util.NewHash(algorithm)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	hasher.Write([]byte(content))
+	return util.HashSum(hasher)
+}
+
+func TestSpoolRecordsDigests(t *testing.T) {
+	directory, err := ioutil.TempDir("", "tram-spool")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(directory)
+
+	spooledFile, err := spool(directory, "http://example.com/", strings.NewReader("tram"), "blake2b", util.DigestAlgorithms)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if spooledFile.Size != 4 || spooledFile.ContentHash != testHash(t, "blake2b", "tram") {
+		t.Error("Unexpected spooled file", spooledFile)
+	}
+	for _, algorithm := range util.DigestAlgorithms {
+		if spooledFile.Digests[algorithm] != testHash(t, algorithm, "tram") {
+			t.Error("Expected the", algorithm, "digest to be recorded but got", spooledFile.Digests)
+		}
+	}
+}
+
+func TestVerifyDigest(t *testing.T) {
+	sha1 := testHash(t, "sha1", "tram")
+	sha256 := testHash(t, "sha256", "tram")
+	cachedFile := newTestCachedFile(sha1, "http://example.com/", "tram", 4, time.Now())
+	cachedFile.Attributes()[digestAttributePrefix+"sha256"] = sha256
+
+	tests := []struct {
+		digest   *util.Digest
+		expected codederror.CodedError
+	}{
+		{nil, nil},
+		{&util.Digest{Algorithm: "sha256", Value: sha256}, nil},
+		{&util.Digest{Algorithm: "sha256", Value: strings.Repeat("0", 64)}, ErrorChecksumMismatch},
+		// The content is addressed by its sha1 hash, so no sha1 digest is
+		// needed to verify it.
+		{&util.Digest{Algorithm: "sha1", Value: sha1}, nil},
+		{&util.Digest{Algorithm: "sha1", Value: strings.Repeat("0", 40)}, ErrorChecksumMismatch},
+		{&util.Digest{Algorithm: "sha512", Value: testHash(t, "sha512", "tram")}, ErrorDigestUnavailable},
+	}
+	for _, test := range tests {
+		err := verifyDigest(cachedFile, test.digest)
+		if test.expected == nil && err != nil {
+			t.Error("Expected", test.digest, "to be verified but got", err)
+		}
+		if test.expected != nil && !isCodedError(err, test.expected) {
+			t.Error("Expected", test.expected, "for", test.digest, "but got", err)
+		}
+	}
+}
@@ -13,19 +13,46 @@ type AppConfig struct {
 	Listen  string `json:"listen"`
 	LruSize uint64 `json:"lurSize"`
 	Storage struct {
-		Engine      string   `json:"engine"`
-		BasePath    string   `json:"basePath"`
-		S3Key       string   `json:"s3Key"`
-		S3Secret    string   `json:"s3Secret"`
-		S3Buckets   []string `json:"s3Buckets"`
-		S3Host      string   `json:"s3Host"`
-		S3VerifySsl bool     `json:"s3VerifySsl"`
+		Engine        string   `json:"engine"`
+		BasePath      string   `json:"basePath"`
+		S3Key         string   `json:"s3Key"`
+		S3Secret      string   `json:"s3Secret"`
+		S3Buckets     []string `json:"s3Buckets"`
+		S3Host        string   `json:"s3Host"`
+		S3VerifySsl   bool     `json:"s3VerifySsl"`
+		SpoolPath     string   `json:"spoolPath"`
+		HashAlgorithm string   `json:"hashAlgorithm"`
 	} `json:"storage"`
 	Index struct {
 		Engine        string `json:"engine"`
 		LocalBasePath string `json:"localBasePath"`
 	} `json:"index"`
-	Source string `json:"-"`
+	Api struct {
+		AliasPattern string   `json:"aliasPattern"`
+		Tokens       []string `json:"tokens"`
+	} `json:"api"`
+	Fetch struct {
+		Headers              []string `json:"headers"`
+		CacheableStatusCodes []int    `json:"cacheableStatusCodes"`
+		MaxSize              int64    `json:"maxSize"`
+		Allow                []string `json:"allow"`
+		Deny                 []string `json:"deny"`
+		AllowedNetworks      []string `json:"allowedNetworks"`
+		NoProxy              []string `json:"noProxy"`
+		FetchSettings
+	} `json:"fetch"`
+	Workers struct {
+		Concurrency int `json:"concurrency"`
+		PerHost     int `json:"perHost"`
+		QueueSize   int `json:"queueSize"`
+	} `json:"workers"`
+	Cache struct {
+		WaitTimeout        int `json:"waitTimeout"`
+		ListenerTimeout    int `json:"listenerTimeout"`
+		RevalidateInterval int `json:"revalidateInterval"`
+	} `json:"cache"`
+	Origins []OriginConfig `json:"origins"`
+	Source  string         `json:"-"`
 }
 
 func LoadAppConfig(givenPath string) (*AppConfig, error) {
@@ -0,0 +1,74 @@
+package config
+
+// FetchSettings control the timeouts, retries and tls used when fetching
+// urls. Timeouts are in seconds and backoffs are in milliseconds. Zero values,
+// and a nil Retries, fall back to the global fetch settings and then to the
+// defaults. The CA bundles of an origin are trusted in addition to the global
+// CA bundles. The proxy is a url, or "direct" to disable proxies. Rate limits
+// apply to each host separately.
+type FetchSettings struct {
+	ConnectTimeout  int  `json:"connectTimeout"`
+	HeaderTimeout   int  `json:"headerTimeout"`
+	IdleTimeout     int  `json:"idleTimeout"`
+	TotalTimeout    int  `json:"totalTimeout"`
+	Retries         *int `json:"retries"`
+	RetryBackoff    int  `json:"retryBackoff"`
+	MaxRetryBackoff int  `json:"maxRetryBackoff"`
+
+	CaBundles  []string `json:"caBundles"`
+	ClientCert string   `json:"clientCert"`
+	ClientKey  string   `json:"clientKey"`
+
+	Proxy string `json:"proxy"`
+
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	BytesPerSecond    int64   `json:"bytesPerSecond"`
+}
+
+// FetchSettings returns the fetch settings for the url, preferring the
+// settings of its origin over the global fetch settings.
+func (appConfig *AppConfig) FetchSettings(rawUrl string) FetchSettings {
+	settings := appConfig.Fetch.FetchSettings
+	origin := appConfig.Origin(rawUrl)
+	if origin == nil {
+		return settings
+	}
+	if origin.ConnectTimeout > 0 {
+		settings.ConnectTimeout = origin.ConnectTimeout
+	}
+	if origin.HeaderTimeout > 0 {
+		settings.HeaderTimeout = origin.HeaderTimeout
+	}
+	if origin.IdleTimeout > 0 {
+		settings.IdleTimeout = origin.IdleTimeout
+	}
+	if origin.TotalTimeout > 0 {
+		settings.TotalTimeout = origin.TotalTimeout
+	}
+	if origin.Retries != nil {
+		settings.Retries = origin.Retries
+	}
+	if origin.RetryBackoff > 0 {
+		settings.RetryBackoff = origin.RetryBackoff
+	}
+	if origin.MaxRetryBackoff > 0 {
+		settings.MaxRetryBackoff = origin.MaxRetryBackoff
+	}
+	if len(origin.CaBundles) > 0 {
+		settings.CaBundles = append(append([]string{}, settings.CaBundles...), origin.CaBundles...)
+	}
+	if origin.RequestsPerSecond > 0 {
+		settings.RequestsPerSecond = origin.RequestsPerSecond
+	}
+	if origin.BytesPerSecond > 0 {
+		settings.BytesPerSecond = origin.BytesPerSecond
+	}
+	if origin.Proxy != "" {
+		settings.Proxy = origin.Proxy
+	}
+	if origin.ClientCert != "" {
+		settings.ClientCert = origin.ClientCert
+		settings.ClientKey = origin.ClientKey
+	}
+	return settings
+}
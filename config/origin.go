@@ -0,0 +1,106 @@
+package config
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OriginConfig contains settings that apply to the urls of a single origin.
+// The host is matched against the host of the url, with or without a port,
+// and the prefix is matched against the start of the url. When both are set,
+// both must match. Insecure disables verification of the certificates of the
+// origin. MaxConcurrency replaces the per-host limit on concurrent downloads.
+//
+// RequestHeaders are added to every request sent to the origin. A bearer
+// token or a username and password can be given directly or, to keep them out
+// of the config, read from a file when each request is made.
+type OriginConfig struct {
+	Host           string `json:"host"`
+	Prefix         string `json:"prefix"`
+	MaxSize        int64  `json:"maxSize"`
+	Insecure       bool   `json:"insecure"`
+	MaxConcurrency int    `json:"maxConcurrency"`
+	FetchSettings
+
+	RequestHeaders  map[string]string `json:"requestHeaders"`
+	BearerToken     string            `json:"bearerToken"`
+	BearerTokenFile string            `json:"bearerTokenFile"`
+	Username        string            `json:"username"`
+	Password        string            `json:"password"`
+	PasswordFile    string            `json:"passwordFile"`
+}
+
+// Origin returns the first origin config that matches the url or nil if none
+// match.
+func (appConfig *AppConfig) Origin(rawUrl string) *OriginConfig {
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil
+	}
+	for index, origin := range appConfig.Origins {
+		if origin.matches(rawUrl, parsedUrl) {
+			return &appConfig.Origins[index]
+		}
+	}
+	return nil
+}
+
+func (origin OriginConfig) matches(rawUrl string, parsedUrl *url.URL) bool {
+	if origin.Host == "" && origin.Prefix == "" {
+		return false
+	}
+	if origin.Prefix != "" && !strings.HasPrefix(rawUrl, origin.Prefix) {
+		return false
+	}
+	if origin.Host != "" && !strings.EqualFold(origin.Host, parsedUrl.Host) && !strings.EqualFold(origin.Host, parsedUrl.Hostname()) {
+		return false
+	}
+	return true
+}
+
+// RequestHeader returns the headers and credentials sent with requests to the
+// origin. Credential files are read each time so that they can be rotated
+// without restarting.
+func (origin *OriginConfig) RequestHeader() (http.Header, error) {
+	header := make(http.Header)
+	for name, value := range origin.RequestHeaders {
+		header.Set(name, value)
+	}
+
+	bearerToken := origin.BearerToken
+	if origin.BearerTokenFile != "" {
+		token, err := readCredential(origin.BearerTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		bearerToken = token
+	}
+	if bearerToken != "" {
+		header.Set("Authorization", "Bearer "+bearerToken)
+	}
+
+	if origin.Username != "" {
+		password := origin.Password
+		if origin.PasswordFile != "" {
+			filePassword, err := readCredential(origin.PasswordFile)
+			if err != nil {
+				return nil, err
+			}
+			password = filePassword
+		}
+		credentials := base64.StdEncoding.EncodeToString([]byte(origin.Username + ":" + password))
+		header.Set("Authorization", "Basic "+credentials)
+	}
+	return header, nil
+}
+
+func readCredential(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const redacted = "[redacted]"
+
+// Redacted returns the config as JSON with secrets, such as storage keys, api
+// tokens, origin credentials and proxy credentials, replaced.
+func (appConfig *AppConfig) Redacted() string {
+	copied := *appConfig
+	if copied.Storage.S3Secret != "" {
+		copied.Storage.S3Secret = redacted
+	}
+	copied.Api.Tokens = redactAll(copied.Api.Tokens)
+	copied.Fetch.Proxy = redactProxy(copied.Fetch.Proxy)
+	copied.Origins = make([]OriginConfig, len(appConfig.Origins))
+	for index, origin := range appConfig.Origins {
+		copied.Origins[index] = origin.redacted()
+	}
+	data, err := json.MarshalIndent(copied, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// String returns the redacted config so that secrets are not logged.
+func (appConfig *AppConfig) String() string {
+	return appConfig.Redacted()
+}
+
+func (origin OriginConfig) redacted() OriginConfig {
+	if len(origin.RequestHeaders) > 0 {
+		requestHeaders := make(map[string]string)
+		for name := range origin.RequestHeaders {
+			requestHeaders[name] = redacted
+		}
+		origin.RequestHeaders = requestHeaders
+	}
+	if origin.BearerToken != "" {
+		origin.BearerToken = redacted
+	}
+	if origin.Password != "" {
+		origin.Password = redacted
+	}
+	origin.Proxy = redactProxy(origin.Proxy)
+	return origin
+}
+
+// redactProxy replaces the username and password of a proxy url, which may be
+// given with or without a scheme.
+func redactProxy(proxy string) string {
+	at := strings.LastIndex(proxy, "@")
+	if at < 0 {
+		return proxy
+	}
+	scheme := ""
+	if index := strings.Index(proxy, "://"); index >= 0 && index < at {
+		scheme = proxy[:index+3]
+	}
+	return scheme + redacted + "@" + proxy[at+1:]
+}
+
+func redactAll(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	redactedValues := make([]string, len(values))
+	for index := range values {
+		redactedValues[index] = redacted
+	}
+	return redactedValues
+}
@@ -0,0 +1,56 @@
+package util
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"strings"
+)
+
+// DigestAlgorithms are the algorithms that expected digests can use.
+var DigestAlgorithms = []string{"sha1", "sha256", "sha512"}
+
+// Digest is an expected digest of content, such as sha256=<hex>.
+type Digest struct {
+	Algorithm string
+	Value     string
+}
+
+// ParseDigest parses a digest in the form <algorithm>=<hex>. The algorithm
+// is one of DigestAlgorithms and the value is hex encoded.
+func ParseDigest(value string) (*Digest, error) {
+	parts := strings.SplitN(strings.TrimSpace(value), "=", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("The digest must be in the form algorithm=hex")
+	}
+	algorithm := strings.ToLower(parts[0])
+	hasher, err := NewDigestHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := hex.DecodeString(parts[1])
+	if err != nil || len(decoded) != hasher.Size() {
+		return nil, errors.New("The digest value is not a valid " + algorithm + " digest")
+	}
+	return &Digest{algorithm, hex.EncodeToString(decoded)}, nil
+}
+
+func (digest *Digest) String() string {
+	return digest.Algorithm + "=" + digest.Value
+}
+
+// NewDigestHash returns a new hash for the digest algorithm.
+func NewDigestHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, errors.New("Unsupported digest algorithm " + algorithm)
+}
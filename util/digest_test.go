@@ -0,0 +1,21 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestParseDigest(t *testing.T) {
+	digest, err := ParseDigest("SHA256=E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if digest.String() != "sha256=e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Error("Unexpected digest", digest.String())
+	}
+
+	for _, invalid := range []string{"", "sha256", "md5=d41d8cd98f00b204e9800998ecf8427e", "sha1=abc", "sha1=zz39a3ee5e6b4b0d3255bfef95601890afd80709"} {
+		if _, err := ParseDigest(invalid); err == nil {
+			t.Error("Expected an error for", invalid)
+		}
+	}
+}
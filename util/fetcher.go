@@ -0,0 +1,311 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultConnectTimeout  = 5 * time.Second
+	DefaultHeaderTimeout   = 30 * time.Second
+	DefaultIdleTimeout     = 60 * time.Second
+	DefaultRetries         = 2
+	DefaultRetryBackoff    = 250 * time.Millisecond
+	DefaultMaxRetryBackoff = 5 * time.Second
+	DefaultMaxRedirects    = 10
+)
+
+// RemoteFile is the response of a fetched url. The body is streamed from the
+// origin and must be closed by the caller.
+type RemoteFile struct {
+	Url           string
+	StatusCode    int
+	Header        http.Header
+	ContentLength int64
+	Body          io.ReadCloser
+}
+
+// FetchOptions changes how a url is fetched.
+type FetchOptions struct {
+	// CacheableStatusCodes are the response status codes that can be cached.
+	// When empty, only 200 responses can be cached.
+	CacheableStatusCodes []int
+
+	// Header contains the headers, including any credentials, sent with the
+	// request.
+	Header http.Header
+
+	// ConnectTimeout limits the time taken to connect to the origin.
+	ConnectTimeout time.Duration
+	// HeaderTimeout limits the time waiting for the origin to send the
+	// response headers once the request has been sent.
+	HeaderTimeout time.Duration
+	// IdleTimeout limits the time the connection can go without reading or
+	// writing any data, including while the body is streamed.
+	IdleTimeout time.Duration
+	// TotalTimeout limits the time taken by the whole request, including
+	// reading the body. Zero means that there is no limit.
+	TotalTimeout time.Duration
+
+	// Retries is the number of times a request is retried after a timeout, a
+	// connection that was refused or reset, or a 500, 502, 503 or 504
+	// response.
+	Retries int
+	// RetryBackoff is the delay before the first retry. The delay doubles
+	// with each retry, up to MaxRetryBackoff, and is randomly reduced by up
+	// to half so that retries from many clients are spread out.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+
+	// InsecureSkipVerify disables verification of the certificate of the
+	// origin.
+	InsecureSkipVerify bool
+	// CaBundles are paths to PEM encoded certificates that are trusted in
+	// addition to the system roots.
+	CaBundles []string
+	// ClientCert and ClientKey are paths to the PEM encoded certificate and
+	// key presented to origins that require client certificates.
+	ClientCert string
+	ClientKey  string
+
+	// Allow and Deny are rules, as described by CheckUrl, that the url and
+	// every url it redirects to are checked against.
+	Allow []string
+	Deny  []string
+	// BlockPrivateNetworks refuses connections to loopback, private and
+	// link-local addresses, other than those in AllowedNetworks.
+	BlockPrivateNetworks bool
+	AllowedNetworks      []string
+	// MaxRedirects limits the number of redirects that are followed. When
+	// zero, DefaultMaxRedirects is used.
+	MaxRedirects int
+
+	// Proxy is the url of the http, https or socks5 proxy that requests are
+	// sent through. When empty, the proxy is taken from the environment, and
+	// DirectProxy disables proxies. NoProxy contains rules, as described by
+	// CheckUrl, for urls that are fetched without the proxy.
+	Proxy   string
+	NoProxy []string
+
+	// RequestsPerSecond and BytesPerSecond limit the rate that the host of
+	// the url is fetched from when the fetcher is wrapped by
+	// RateLimitedFetcher. Zero means that there is no limit.
+	RequestsPerSecond float64
+	BytesPerSecond    int64
+
+	// IfNoneMatch and IfModifiedSince make the request conditional. When
+	// either is set, a 304 response is returned rather than treated as an
+	// error, and its body must still be closed.
+	IfNoneMatch     string
+	IfModifiedSince string
+
+	// waitForRequest is called before every attempt, including retries. It
+	// is set by RateLimitedFetcher.
+	waitForRequest func()
+}
+
+func (options FetchOptions) isConditional() bool {
+	return options.IfNoneMatch != "" || options.IfModifiedSince != ""
+}
+
+// DefaultFetchOptions returns the options used when none are configured.
+func DefaultFetchOptions() FetchOptions {
+	return FetchOptions{
+		ConnectTimeout:  DefaultConnectTimeout,
+		HeaderTimeout:   DefaultHeaderTimeout,
+		IdleTimeout:     DefaultIdleTimeout,
+		Retries:         DefaultRetries,
+		RetryBackoff:    DefaultRetryBackoff,
+		MaxRetryBackoff: DefaultMaxRetryBackoff,
+
+		BlockPrivateNetworks: true,
+	}
+}
+
+type RemoteFileFetcher func(url string, options FetchOptions) (*RemoteFile, error)
+
+// FetchError is returned when a url could not be fetched. The StatusCode is
+// the status of the response from the origin or 0 if there was no response.
+type FetchError struct {
+	Url        string
+	StatusCode int
+	Err        error
+}
+
+func (err *FetchError) Error() string {
+	if err.Err != nil {
+		return fmt.Sprintf("Could not fetch %s: %s", err.Url, err.Err.Error())
+	}
+	return fmt.Sprintf("Could not fetch %s: origin returned status %d", err.Url, err.StatusCode)
+}
+
+// Timeout returns true if the origin did not respond in time.
+func (err *FetchError) Timeout() bool {
+	if netErr, ok := err.Err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	return err.StatusCode == http.StatusGatewayTimeout
+}
+
+func (options FetchOptions) isCacheable(statusCode int) bool {
+	if len(options.CacheableStatusCodes) == 0 {
+		return statusCode == http.StatusOK
+	}
+	for _, cacheableStatusCode := range options.CacheableStatusCodes {
+		if statusCode == cacheableStatusCode {
+			return true
+		}
+	}
+	return false
+}
+
+func (options FetchOptions) clientKey() fetchClientKey {
+	return fetchClientKey{
+		connectTimeout: options.ConnectTimeout,
+		headerTimeout:  options.HeaderTimeout,
+		idleTimeout:    options.IdleTimeout,
+		totalTimeout:   options.TotalTimeout,
+
+		insecureSkipVerify: options.InsecureSkipVerify,
+		caBundles:          strings.Join(options.CaBundles, "\n"),
+		clientCert:         options.ClientCert,
+		clientKey:          options.ClientKey,
+
+		blockPrivateNetworks: options.BlockPrivateNetworks,
+		allowedNetworks:      strings.Join(options.AllowedNetworks, ","),
+
+		proxy:   options.Proxy,
+		noProxy: strings.Join(options.NoProxy, ","),
+	}
+}
+
+// backoff returns the delay before the given retry, starting at 1.
+func (options FetchOptions) backoff(retry int) time.Duration {
+	delay := options.RetryBackoff
+	for i := 1; i < retry && delay < options.MaxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if options.MaxRetryBackoff > 0 && delay > options.MaxRetryBackoff {
+		delay = options.MaxRetryBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// shouldRetry returns true if the failed fetch may succeed when retried.
+// Timeouts, connections that were refused or reset and 500, 502, 503 and 504
+// responses are retried. Other errors, such as certificates that could not be
+// verified or too many redirects, fail the same way every time.
+func shouldRetry(err *FetchError) bool {
+	if err.Err == nil {
+		switch err.StatusCode {
+		case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if err.Timeout() {
+		return true
+	}
+	for _, retryable := range []error{syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.ECONNABORTED, io.EOF, io.ErrUnexpectedEOF} {
+		if errors.Is(err.Err, retryable) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultRemoteFileFetcher fetches the url, retrying the errors described by
+// shouldRetry as configured by the options. The url and every redirect are
+// checked against the allow and deny rules of the options.
+func DefaultRemoteFileFetcher(url string, options FetchOptions) (*RemoteFile, error) {
+	err := CheckUrl(url, options.Allow, options.Deny)
+	if err != nil {
+		log.Println(err)
+		return nil, &FetchError{url, 0, err}
+	}
+	httpClient, err := fetchClient(options)
+	if err != nil {
+		log.Println(err)
+		return nil, &FetchError{url, 0, err}
+	}
+	for retry := 1; ; retry++ {
+		if options.waitForRequest != nil {
+			options.waitForRequest()
+		}
+		remoteFile, err := fetch(httpClient, url, options)
+		if err == nil {
+			return remoteFile, nil
+		}
+		if retry > options.Retries || !shouldRetry(err) {
+			return nil, err
+		}
+		delay := options.backoff(retry)
+		log.Println("Retrying", url, "in", delay)
+		time.Sleep(delay)
+	}
+}
+
+func fetch(httpClient *http.Client, url string, options FetchOptions) (*RemoteFile, *FetchError) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, &FetchError{url, 0, err}
+	}
+	for name, values := range options.Header {
+		req.Header[name] = values
+	}
+	if options.IfNoneMatch != "" {
+		req.Header.Set("If-None-Match", options.IfNoneMatch)
+	}
+	if options.IfModifiedSince != "" {
+		req.Header.Set("If-Modified-Since", options.IfModifiedSince)
+	}
+	resp, err := withRedirectChecks(httpClient, options).Do(req)
+	if err != nil {
+		log.Println(err)
+		if blocked := blockedError(err); blocked != nil {
+			return nil, &FetchError{url, 0, blocked}
+		}
+		return nil, &FetchError{url, 0, err}
+	}
+	notModified := resp.StatusCode == http.StatusNotModified && options.isConditional()
+	if !notModified && !options.isCacheable(resp.StatusCode) {
+		resp.Body.Close()
+		log.Println("Not caching", url, "because the origin returned status", resp.StatusCode)
+		return nil, &FetchError{url, resp.StatusCode, nil}
+	}
+	return &RemoteFile{url, resp.StatusCode, resp.Header, resp.ContentLength, resp.Body}, nil
+}
+
+// withRedirectChecks returns a copy of the client that checks each redirect
+// against the rules of the options. The configured headers, which may contain
+// credentials, are not sent to redirects to other hosts.
+func withRedirectChecks(httpClient *http.Client, options FetchOptions) *http.Client {
+	maxRedirects := options.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = DefaultMaxRedirects
+	}
+	checkedClient := *httpClient
+	checkedClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("Stopped after %d redirects", maxRedirects)
+		}
+		if !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+			for name := range options.Header {
+				req.Header.Del(name)
+			}
+		}
+		return CheckUrl(req.URL.String(), options.Allow, options.Deny)
+	}
+	return &checkedClient
+}
@@ -0,0 +1,410 @@
+package util
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFetchOk(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/plain")
+		res.Write([]byte("tram"))
+	}))
+	defer server.Close()
+
+	remoteFile, err := DefaultRemoteFileFetcher(server.URL, FetchOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer remoteFile.Body.Close()
+	body, err := ioutil.ReadAll(remoteFile.Body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(body) != "tram" {
+		t.Error("Unexpected body", string(body))
+	}
+	if remoteFile.Header.Get("Content-Type") != "text/plain" {
+		t.Error("Unexpected content type", remoteFile.Header.Get("Content-Type"))
+	}
+}
+
+func TestFetchErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(503)
+		res.Write([]byte("unavailable"))
+	}))
+	defer server.Close()
+
+	remoteFile, err := DefaultRemoteFileFetcher(server.URL, FetchOptions{})
+	if remoteFile != nil {
+		t.Error("A 503 response should not be returned.")
+	}
+	fetchError, ok := err.(*FetchError)
+	if !ok {
+		t.Fatal("Expected a FetchError but got", err)
+	}
+	if fetchError.StatusCode != 503 {
+		t.Error("Expected status 503 but got", fetchError.StatusCode)
+	}
+}
+
+func TestFetchCacheableStatusCodes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(203)
+		res.Write([]byte("tram"))
+	}))
+	defer server.Close()
+
+	_, err := DefaultRemoteFileFetcher(server.URL, FetchOptions{})
+	if err == nil {
+		t.Error("A 203 response should not be cached by default.")
+	}
+
+	remoteFile, err := DefaultRemoteFileFetcher(server.URL, FetchOptions{CacheableStatusCodes: []int{200, 203}})
+	if err != nil {
+		t.Fatal("A 203 response should be cached when configured.", err)
+	}
+	remoteFile.Body.Close()
+}
+
+func TestFetchRetries(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts < 3 {
+			res.WriteHeader(503)
+			return
+		}
+		res.Write([]byte("tram"))
+	}))
+	defer server.Close()
+
+	_, err := DefaultRemoteFileFetcher(server.URL, FetchOptions{Retries: 1, RetryBackoff: time.Millisecond})
+	if err == nil {
+		t.Fatal("Expected an error after a single retry.")
+	}
+
+	attempts = 0
+	remoteFile, err := DefaultRemoteFileFetcher(server.URL, FetchOptions{Retries: 2, RetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal("Expected the fetch to succeed after retrying.", err)
+	}
+	remoteFile.Body.Close()
+	if attempts != 3 {
+		t.Error("Expected 3 attempts but got", attempts)
+	}
+}
+
+func TestFetchDoesNotRetryClientErrors(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		attempts++
+		res.WriteHeader(404)
+	}))
+	defer server.Close()
+
+	_, err := DefaultRemoteFileFetcher(server.URL, FetchOptions{Retries: 2, RetryBackoff: time.Millisecond})
+	if err == nil {
+		t.Fatal("Expected an error for a 404 response.")
+	}
+	if attempts != 1 {
+		t.Error("Expected 1 attempt but got", attempts)
+	}
+}
+
+func TestFetchDoesNotRetryPermanentErrors(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		attempts++
+		if req.URL.Path == "/unimplemented" {
+			res.WriteHeader(501)
+			return
+		}
+		http.Redirect(res, req, "/loop", 302)
+	}))
+	defer server.Close()
+
+	options := FetchOptions{Retries: 2, RetryBackoff: time.Millisecond, MaxRedirects: 2}
+	_, err := DefaultRemoteFileFetcher(server.URL+"/unimplemented", options)
+	if err == nil || attempts != 1 {
+		t.Error("Expected a single attempt for a 501 response but got", attempts, err)
+	}
+
+	attempts = 0
+	_, err = DefaultRemoteFileFetcher(server.URL+"/loop", options)
+	if err == nil || attempts != 2 {
+		t.Error("Expected too many redirects not to be retried but got", attempts, "requests", err)
+	}
+
+	attempts = 0
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	defer tlsServer.Close()
+	start := time.Now()
+	_, err = DefaultRemoteFileFetcher(tlsServer.URL, FetchOptions{Retries: 2, RetryBackoff: time.Second})
+	if err == nil || time.Since(start) > 500*time.Millisecond {
+		t.Error("Expected an unverified certificate not to be retried.", err)
+	}
+}
+
+func TestFetchVerifiesCertificates(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte("tram"))
+	}))
+	defer server.Close()
+
+	_, err := DefaultRemoteFileFetcher(server.URL, FetchOptions{})
+	if err == nil {
+		t.Fatal("An untrusted certificate should not be accepted.")
+	}
+
+	remoteFile, err := DefaultRemoteFileFetcher(server.URL, FetchOptions{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal("An untrusted certificate should be accepted when verification is disabled.", err)
+	}
+	remoteFile.Body.Close()
+
+	caBundle, err := ioutil.TempFile("", "tram-ca-")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(caBundle.Name())
+	pem.Encode(caBundle, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	caBundle.Close()
+
+	remoteFile, err = DefaultRemoteFileFetcher(server.URL, FetchOptions{CaBundles: []string{caBundle.Name()}})
+	if err != nil {
+		t.Fatal("A certificate from a configured CA bundle should be accepted.", err)
+	}
+	remoteFile.Body.Close()
+}
+
+func TestFetchHeader(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			res.WriteHeader(401)
+			return
+		}
+		res.Write([]byte("tram"))
+	}))
+	defer server.Close()
+
+	header := make(http.Header)
+	header.Set("Authorization", "Bearer secret")
+	remoteFile, err := DefaultRemoteFileFetcher(server.URL, FetchOptions{Header: header})
+	if err != nil {
+		t.Fatal("Expected the header to be sent.", err)
+	}
+	remoteFile.Body.Close()
+}
+
+func TestFetchDropsHeaderOnRedirectToOtherHost(t *testing.T) {
+	leaked := ""
+	target := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		leaked = req.Header.Get("X-Api-Key")
+		res.Write([]byte("tram"))
+	}))
+	defer target.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/same" {
+			http.Redirect(res, req, "/other", 302)
+			return
+		}
+		if req.URL.Path == "/other" && req.Header.Get("X-Api-Key") == "" {
+			res.WriteHeader(401)
+			return
+		}
+		http.Redirect(res, req, target.URL, 302)
+	}))
+	defer server.Close()
+
+	header := make(http.Header)
+	header.Set("X-Api-Key", "secret")
+	remoteFile, err := DefaultRemoteFileFetcher(server.URL+"/same", FetchOptions{Header: header})
+	if err != nil {
+		t.Fatal("Expected the header to be sent to redirects to the same host.", err)
+	}
+	remoteFile.Body.Close()
+	if leaked != "" {
+		t.Error("Expected the header not to be sent to another host.")
+	}
+}
+
+func TestFetchBlocksPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte("tram"))
+	}))
+	defer server.Close()
+
+	_, err := DefaultRemoteFileFetcher(server.URL, FetchOptions{BlockPrivateNetworks: true, Retries: 2})
+	fetchError, ok := err.(*FetchError)
+	if !ok {
+		t.Fatal("Expected a FetchError but got", err)
+	}
+	if _, blocked := fetchError.Err.(*BlockedError); !blocked {
+		t.Fatal("Expected a BlockedError but got", fetchError.Err)
+	}
+
+	remoteFile, err := DefaultRemoteFileFetcher(server.URL, FetchOptions{BlockPrivateNetworks: true, AllowedNetworks: []string{"127.0.0.0/8", "::1/128"}})
+	if err != nil {
+		t.Fatal("Expected an allowed network to be fetched.", err)
+	}
+	remoteFile.Body.Close()
+}
+
+func TestIsPrivateAddress(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1":          true,
+		"10.1.2.3":           true,
+		"169.254.169.254":    true,
+		"100.64.0.1":         true,
+		"100.100.100.200":    true,
+		"::1":                true,
+		"fe80::1":            true,
+		"64:ff9b::a9fe:a9fe": true,
+		"64:ff9b::6440:1":    true,
+		"64:ff9b::cb00:710a": false,
+		"100.128.0.1":        false,
+		"203.0.113.10":       false,
+		"2001:db8::1":        false,
+	}
+	for address, expected := range tests {
+		if IsPrivateAddress(net.ParseIP(address)) != expected {
+			t.Error("Expected", address, "to be private:", expected)
+		}
+	}
+}
+
+func TestFetchChecksRedirects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		http.Redirect(res, req, "http://169.254.169.254/latest/meta-data/", 302)
+	}))
+	defer server.Close()
+
+	_, err := DefaultRemoteFileFetcher(server.URL, FetchOptions{Deny: []string{"169.254.169.254"}})
+	fetchError, ok := err.(*FetchError)
+	if !ok {
+		t.Fatal("Expected a FetchError but got", err)
+	}
+	if _, blocked := fetchError.Err.(*BlockedError); !blocked {
+		t.Fatal("Expected a BlockedError but got", fetchError.Err)
+	}
+}
+
+func TestCheckUrl(t *testing.T) {
+	cases := []struct {
+		url     string
+		allow   []string
+		deny    []string
+		allowed bool
+	}{
+		{"http://example.com/a", nil, nil, true},
+		{"http://example.com/a", []string{"example.com"}, nil, true},
+		{"http://example.org/a", []string{"example.com"}, nil, false},
+		{"https://cdn.example.com/a", []string{"*.example.com"}, nil, true},
+		{"http://cdn.example.com/a", []string{"https://*.example.com"}, nil, false},
+		{"https://example.com:8443/a", []string{"example.com:443"}, nil, false},
+		{"https://example.com/a", []string{"example.com:443"}, nil, true},
+		{"https://admin.example.com/a", []string{"*"}, []string{"admin.example.com"}, false},
+	}
+	for _, c := range cases {
+		err := CheckUrl(c.url, c.allow, c.deny)
+		if (err == nil) != c.allowed {
+			t.Error("Unexpected result for", c.url, c.allow, c.deny, err)
+		}
+	}
+}
+
+func TestFetchProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Host != "203.0.113.10" && req.URL.Host != "tram.invalid" {
+			res.WriteHeader(502)
+			return
+		}
+		res.Write([]byte("proxied"))
+	}))
+	defer proxy.Close()
+
+	// Hosts that cannot be resolved locally are resolved by the proxy.
+	for _, url := range []string{"http://203.0.113.10/file", "http://tram.invalid/file"} {
+		remoteFile, err := DefaultRemoteFileFetcher(url, FetchOptions{Proxy: proxy.URL, BlockPrivateNetworks: true})
+		if err != nil {
+			t.Fatal("Expected the request to be sent through the proxy.", err)
+		}
+		body, err := ioutil.ReadAll(remoteFile.Body)
+		remoteFile.Body.Close()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(body) != "proxied" {
+			t.Error("Unexpected body", string(body))
+		}
+	}
+}
+
+func TestFetchProxyBlocksPrivateAddresses(t *testing.T) {
+	proxied := 0
+	proxy := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		proxied++
+		res.Write([]byte("proxied"))
+	}))
+	defer proxy.Close()
+
+	options := FetchOptions{Proxy: proxy.URL, BlockPrivateNetworks: true}
+	for _, url := range []string{"http://169.254.169.254/latest/meta-data/", "http://localhost:8080/"} {
+		_, err := DefaultRemoteFileFetcher(url, options)
+		fetchError, ok := err.(*FetchError)
+		if !ok {
+			t.Fatal("Expected a FetchError for", url, "but got", err)
+		}
+		if _, blocked := fetchError.Err.(*BlockedError); !blocked {
+			t.Error("Expected a BlockedError for", url, "but got", fetchError.Err)
+		}
+	}
+	if proxied != 0 {
+		t.Error("Expected no requests to be sent to the proxy but got", proxied)
+	}
+
+	options.AllowedNetworks = []string{"169.254.169.254/32"}
+	remoteFile, err := DefaultRemoteFileFetcher("http://169.254.169.254/latest/meta-data/", options)
+	if err != nil {
+		t.Fatal("Expected an allowed network to be fetched through the proxy.", err)
+	}
+	remoteFile.Body.Close()
+}
+
+func TestFetchConditional(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			res.WriteHeader(304)
+			return
+		}
+		res.Header().Set("ETag", `"v2"`)
+		res.Write([]byte("tram"))
+	}))
+	defer server.Close()
+
+	remoteFile, err := DefaultRemoteFileFetcher(server.URL, FetchOptions{IfNoneMatch: `"v1"`})
+	if err != nil {
+		t.Fatal("A 304 response should be returned for a conditional request.", err)
+	}
+	remoteFile.Body.Close()
+	if remoteFile.StatusCode != 304 {
+		t.Error("Expected status 304 but got", remoteFile.StatusCode)
+	}
+
+	remoteFile, err = DefaultRemoteFileFetcher(server.URL, FetchOptions{IfNoneMatch: `"v0"`})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	remoteFile.Body.Close()
+	if remoteFile.StatusCode != 200 || remoteFile.Header.Get("ETag") != `"v2"` {
+		t.Error("Unexpected response", remoteFile.StatusCode, remoteFile.Header.Get("ETag"))
+	}
+}
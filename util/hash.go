@@ -3,10 +3,28 @@ package util
 import (
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"golang.org/x/crypto/blake2b"
+	"hash"
 )
 
+const (
+	// DefaultHashAlgorithm is used to address new content when no algorithm
+	// is configured.
+	DefaultHashAlgorithm = "sha256"
+	// LegacyHashAlgorithm addresses content stored before the algorithm was
+	// recorded.
+	LegacyHashAlgorithm = "sha1"
+)
+
+// HashAlgorithms are the algorithms that content can be addressed with.
+// BLAKE2b produces a 256 bit digest.
+var HashAlgorithms = []string{"sha1", "sha256", "sha512", "blake2b"}
+
 func ComputeHmac256(message string, secret string) string {
 	key := []byte(secret)
 	h := hmac.New(sha1.New, key)
@@ -14,8 +32,22 @@ func ComputeHmac256(message string, secret string) string {
 	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
-func Hash(bytes []byte) string {
-	hasher := sha1.New()
-	hasher.Write(bytes)
+// NewHash returns a new hash for one of the HashAlgorithms.
+func NewHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "blake2b":
+		return blake2b.New256(nil)
+	}
+	return nil, errors.New("Unsupported hash algorithm " + algorithm)
+}
+
+// HashSum returns the hex encoded sum of the hash.
+func HashSum(hasher hash.Hash) string {
 	return fmt.Sprintf("%x", hasher.Sum(nil))
 }
@@ -0,0 +1,22 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestNewHash(t *testing.T) {
+	expected := map[string]int{"sha1": 40, "sha256": 64, "sha512": 128, "blake2b": 64}
+	for _, algorithm := range HashAlgorithms {
+		hasher, err := NewHash(algorithm)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		hasher.Write([]byte("tram"))
+		if length := len(HashSum(hasher)); length != expected[algorithm] {
+			t.Error("Unexpected length", length, "for", algorithm)
+		}
+	}
+	if _, err := NewHash("md5"); err == nil {
+		t.Error("Expected an error for an unsupported algorithm.")
+	}
+}
@@ -2,27 +2,164 @@ package util
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 )
 
+// NewHttpClient returns a client whose connections fail when no data is read
+// or written for 30 seconds, so that large request and response bodies can be
+// streamed for as long as they keep making progress.
 func NewHttpClient(verifySsl bool, timeout time.Duration) *http.Client {
 	tr := &http.Transport{
 		TLSClientConfig:       &tls.Config{InsecureSkipVerify: !verifySsl},
 		ResponseHeaderTimeout: timeout,
-		Dial: TimeoutDialer(5*time.Second, 30*time.Second),
+		Dial:                  IdleTimeoutDialer(5*time.Second, 30*time.Second),
 	}
 	return &http.Client{Transport: tr}
 }
 
-func TimeoutDialer(cTimeout time.Duration, rwTimeout time.Duration) func(net, addr string) (c net.Conn, err error) {
+// IdleTimeoutDialer returns a dialer whose connections fail when no data is
+// read or written for the idle timeout. A connection that keeps making
+// progress is never closed.
+func IdleTimeoutDialer(cTimeout time.Duration, idleTimeout time.Duration) func(net, addr string) (c net.Conn, err error) {
+	return idleTimeoutDialer(&net.Dialer{Timeout: cTimeout}, idleTimeout)
+}
+
+func idleTimeoutDialer(dialer *net.Dialer, idleTimeout time.Duration) func(net, addr string) (c net.Conn, err error) {
 	return func(netw, addr string) (net.Conn, error) {
-		conn, err := net.DialTimeout(netw, addr, cTimeout)
+		conn, err := dialer.Dial(netw, addr)
+		if err != nil {
+			return nil, err
+		}
+		if idleTimeout <= 0 {
+			return conn, nil
+		}
+		return &idleTimeoutConn{conn, idleTimeout}, nil
+	}
+}
+
+type idleTimeoutConn struct {
+	net.Conn
+	idleTimeout time.Duration
+}
+
+func (conn *idleTimeoutConn) Read(b []byte) (int, error) {
+	conn.Conn.SetDeadline(time.Now().Add(conn.idleTimeout))
+	return conn.Conn.Read(b)
+}
+
+func (conn *idleTimeoutConn) Write(b []byte) (int, error) {
+	conn.Conn.SetDeadline(time.Now().Add(conn.idleTimeout))
+	return conn.Conn.Write(b)
+}
+
+// fetchClientKey contains the options that require a separate http client.
+type fetchClientKey struct {
+	connectTimeout time.Duration
+	headerTimeout  time.Duration
+	idleTimeout    time.Duration
+	totalTimeout   time.Duration
+
+	insecureSkipVerify bool
+	caBundles          string
+	clientCert         string
+	clientKey          string
+
+	blockPrivateNetworks bool
+	allowedNetworks      string
+
+	proxy   string
+	noProxy string
+}
+
+var fetchClients = struct {
+	mu      sync.Mutex
+	clients map[fetchClientKey]*http.Client
+}{clients: make(map[fetchClientKey]*http.Client)}
+
+// fetchClient returns the http client for the options, reusing clients so
+// that connections to origins are kept alive between fetches.
+func fetchClient(options FetchOptions) (*http.Client, error) {
+	key := options.clientKey()
+	fetchClients.mu.Lock()
+	defer fetchClients.mu.Unlock()
+	if client, hasClient := fetchClients.clients[key]; hasClient {
+		return client, nil
+	}
+	tlsConfig, err := newTlsConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	proxyFunc, err := newProxyFunc(options.Proxy, options.NoProxy)
+	if err != nil {
+		return nil, err
+	}
+	dial := idleTimeoutDialer(&net.Dialer{Timeout: key.connectTimeout}, key.idleTimeout)
+	if options.BlockPrivateNetworks {
+		allowedNetworks, err := ParseNetworks(options.AllowedNetworks)
+		if err != nil {
+			return nil, err
+		}
+		checkedDialer := &net.Dialer{Timeout: key.connectTimeout, Control: privateAddressControl(allowedNetworks)}
+		dial = proxyAwareDialer(idleTimeoutDialer(checkedDialer, key.idleTimeout), dial, proxyAddresses(options.Proxy))
+		if proxyFunc != nil {
+			proxyFunc = privateAddressProxyFunc(proxyFunc, allowedNetworks)
+		}
+	}
+	tr := &http.Transport{
+		Proxy:                 proxyFunc,
+		TLSClientConfig:       tlsConfig,
+		ResponseHeaderTimeout: key.headerTimeout,
+		Dial:                  dial,
+	}
+	client := &http.Client{Transport: tr, Timeout: key.totalTimeout}
+	fetchClients.clients[key] = client
+	return client, nil
+}
+
+// proxyAwareDialer uses the proxy dial function for connections to the proxy
+// addresses and the dial function for everything else.
+func proxyAwareDialer(dial, proxyDial func(net, addr string) (net.Conn, error), proxyAddresses map[string]bool) func(net, addr string) (net.Conn, error) {
+	return func(netw, addr string) (net.Conn, error) {
+		if proxyAddresses[addr] {
+			return proxyDial(netw, addr)
+		}
+		return dial(netw, addr)
+	}
+}
+
+// newTlsConfig returns the tls config for the options. Certificates are
+// verified against the system roots and any configured CA bundles unless
+// verification is disabled.
+func newTlsConfig(options FetchOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: options.InsecureSkipVerify}
+	if len(options.CaBundles) > 0 {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil || rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+		for _, caBundle := range options.CaBundles {
+			data, err := ioutil.ReadFile(caBundle)
+			if err != nil {
+				return nil, err
+			}
+			if !rootCAs.AppendCertsFromPEM(data) {
+				return nil, errors.New("No certificates found in CA bundle " + caBundle)
+			}
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	if options.ClientCert != "" {
+		certificate, err := tls.LoadX509KeyPair(options.ClientCert, options.ClientKey)
 		if err != nil {
 			return nil, err
 		}
-		conn.SetDeadline(time.Now().Add(rwTimeout))
-		return conn, nil
+		tlsConfig.Certificates = []tls.Certificate{certificate}
 	}
+	return tlsConfig, nil
 }
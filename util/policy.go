@@ -0,0 +1,173 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// BlockedError is returned when a url, or an address that it resolves to,
+// is not allowed to be fetched.
+type BlockedError struct {
+	Url    string
+	Reason string
+}
+
+func (err *BlockedError) Error() string {
+	return fmt.Sprintf("Not allowed to fetch %s: %s", err.Url, err.Reason)
+}
+
+// CheckUrl returns a BlockedError if the url matches any of the deny rules or
+// if there are allow rules and the url matches none of them.
+//
+// Rules have the form [scheme://]host[:port]. The host can be * to match any
+// host or start with *. to match any subdomain. A rule without a scheme or
+// port matches any scheme or port.
+func CheckUrl(rawUrl string, allow, deny []string) error {
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return &BlockedError{rawUrl, "the url could not be parsed"}
+	}
+	for _, rule := range deny {
+		if matchesRule(rule, parsedUrl) {
+			return &BlockedError{rawUrl, "the url matches the deny rule " + rule}
+		}
+	}
+	if len(allow) == 0 {
+		return nil
+	}
+	for _, rule := range allow {
+		if matchesRule(rule, parsedUrl) {
+			return nil
+		}
+	}
+	return &BlockedError{rawUrl, "the url does not match any allow rule"}
+}
+
+func matchesRule(rule string, parsedUrl *url.URL) bool {
+	hostRule := rule
+	if index := strings.Index(rule, "://"); index != -1 {
+		if !strings.EqualFold(rule[:index], parsedUrl.Scheme) {
+			return false
+		}
+		hostRule = rule[index+3:]
+	}
+	hostRule = strings.TrimSuffix(hostRule, "/")
+
+	host, port := hostRule, ""
+	if splitHost, splitPort, err := net.SplitHostPort(hostRule); err == nil {
+		host, port = splitHost, splitPort
+	}
+	if port != "" && port != urlPort(parsedUrl) {
+		return false
+	}
+
+	hostname := strings.ToLower(parsedUrl.Hostname())
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if host == "*" {
+		return true
+	}
+	if strings.HasPrefix(host, "*.") {
+		return strings.HasSuffix(hostname, host[1:])
+	}
+	return hostname == host
+}
+
+func urlPort(parsedUrl *url.URL) string {
+	if port := parsedUrl.Port(); port != "" {
+		return port
+	}
+	switch strings.ToLower(parsedUrl.Scheme) {
+	case "https":
+		return "443"
+	case "http":
+		return "80"
+	}
+	return ""
+}
+
+// ParseNetworks parses a list of CIDR networks.
+func ParseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, which some clouds use
+// for their metadata endpoints.
+var sharedAddressSpace = mustParseCIDR("100.64.0.0/10")
+
+// nat64Prefix is the well-known NAT64 prefix. Its addresses embed an IPv4
+// address in their last four bytes.
+var nat64Prefix = mustParseCIDR("64:ff9b::/96")
+
+// IsPrivateAddress returns true if the address is a loopback, private,
+// carrier-grade NAT, link-local or unspecified address. NAT64 addresses are
+// private if the IPv4 address they embed is.
+func IsPrivateAddress(ip net.IP) bool {
+	if nat64Prefix.Contains(ip) {
+		return IsPrivateAddress(net.IP(ip.To16()[12:]))
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || sharedAddressSpace.Contains(ip) || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsUnspecified()
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// privateAddressControl returns a dialer control function that refuses to
+// connect to private addresses outside of the allowed networks. The check is
+// made against the resolved address, so host names that resolve to private
+// addresses are refused as well.
+func privateAddressControl(allowedNetworks []*net.IPNet) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return &BlockedError{address, "the address could not be parsed"}
+		}
+		if !allowedAddress(ip, allowedNetworks) {
+			return &BlockedError{address, "the address is private"}
+		}
+		return nil
+	}
+}
+
+// allowedAddress returns true if the address is not private or is within one
+// of the allowed networks.
+func allowedAddress(ip net.IP, allowedNetworks []*net.IPNet) bool {
+	if !IsPrivateAddress(ip) {
+		return true
+	}
+	for _, allowedNetwork := range allowedNetworks {
+		if allowedNetwork.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockedError returns the BlockedError that caused the error, if any.
+func blockedError(err error) *BlockedError {
+	var blocked *BlockedError
+	if errors.As(err, &blocked) {
+		return blocked
+	}
+	return nil
+}
@@ -1,86 +1,63 @@
 package util
 
 import (
-	"io/ioutil"
-	"log"
 	"sync"
-	"time"
 )
 
-type DedupingDownloader struct {
-	wrappedDownloader RemoteFileFetcher
-	downloadPool      *DownloadPool
-}
-
-type DownloadError struct {
-	message string
-}
-
+// DownloadPool tracks the urls that are being downloaded so that concurrent
+// downloads of the same url can share a single result.
 type DownloadPool struct {
-	mu   sync.Mutex
-	urls map[string]time.Time
+	mu    sync.Mutex
+	calls map[string]*downloadCall
 }
 
-func (err DownloadError) Error() string {
-	return err.message
+// downloadCall is a download that is in progress or has completed.
+type downloadCall struct {
+	wg    sync.WaitGroup
+	value interface{}
+	err   error
+	// waiters is the number of callers waiting on the download in addition
+	// to the caller that started it.
+	waiters int
 }
 
-func (dd *DedupingDownloader) downloader(url string) ([]byte, error) {
-	if dd.downloadPool.IsInTransit(url) {
-		log.Println("Cannot download", url, "because it is already in transit.")
-		return nil, DownloadError{"Url already being downloaded"}
-	}
-	dd.downloadPool.Download(url)
-	body, error := dd.wrappedDownloader(url)
-	dd.downloadPool.Finished(url)
-	return body, error
-}
-
-func (d *DownloadPool) Download(url string) {
+// Do calls fn to download the url unless a download of the url is already in
+// progress, in which case it waits for that download to complete. Every
+// caller receives the same value and error. The returned bool is true if the
+// result came from a download started by another caller.
+func (d *DownloadPool) Do(url string, fn func() (interface{}, error)) (interface{}, error, bool) {
 	d.mu.Lock()
-	d.urls[url] = time.Now()
+	if call, hasCall := d.calls[url]; hasCall {
+		call.waiters++
+		d.mu.Unlock()
+		call.wg.Wait()
+		return call.value, call.err, true
+	}
+	call := new(downloadCall)
+	call.wg.Add(1)
+	d.calls[url] = call
 	d.mu.Unlock()
-}
 
-func (d *DownloadPool) Finished(url string) {
+	call.value, call.err = fn()
+	call.wg.Done()
+
 	d.mu.Lock()
-	delete(d.urls, url)
+	delete(d.calls, url)
 	d.mu.Unlock()
+
+	return call.value, call.err, false
 }
 
-func (d *DownloadPool) IsInTransit(url string) (result bool) {
+// InTransit returns the number of urls being downloaded.
+func (d *DownloadPool) InTransit() int {
 	d.mu.Lock()
-	_, result = d.urls[url]
-	d.mu.Unlock()
-	return
+	defer d.mu.Unlock()
+	return len(d.calls)
 }
 
 func NewDownloadPool() *DownloadPool {
 	downloadPool := new(DownloadPool)
 	downloadPool.mu = sync.Mutex{}
-	downloadPool.urls = make(map[string]time.Time)
+	downloadPool.calls = make(map[string]*downloadCall)
 	return downloadPool
 }
-
-func DedupeWrapDownloader(downloader RemoteFileFetcher) RemoteFileFetcher {
-	dedupingDownloader := new(DedupingDownloader)
-	dedupingDownloader.wrappedDownloader = downloader
-	dedupingDownloader.downloadPool = NewDownloadPool()
-	return dedupingDownloader.downloader
-}
-
-func DefaultRemoteFileFetcher(url string) ([]byte, error) {
-	httpClient := NewHttpClient(false, 30*time.Second)
-	resp, err := httpClient.Get(url)
-	if err != nil {
-		log.Println(err)
-		return nil, err
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Println(err)
-		return nil, err
-	}
-	return body, nil
-}
@@ -1,6 +1,8 @@
 package util
 
 import (
+	"bytes"
+	"io/ioutil"
 	"sync"
 	"testing"
 	"time"
@@ -20,7 +22,7 @@ func (err stringError) Error() string {
 	return err.message
 }
 
-func (mockDownloader *mockDownloader) download(url string) ([]byte, error) {
+func (mockDownloader *mockDownloader) download(url string, options FetchOptions) (*RemoteFile, error) {
 	payload, hasPayload := mockDownloader.payloads[url]
 	if hasPayload {
 		mockDownloader.mu.Lock()
@@ -32,88 +34,118 @@ func (mockDownloader *mockDownloader) download(url string) ([]byte, error) {
 		value += 1
 		mockDownloader.counts[url] = value
 		mockDownloader.mu.Unlock()
-		return payload, nil
+		return &RemoteFile{Url: url, Body: ioutil.NopCloser(bytes.NewReader(payload))}, nil
 	}
 	return nil, stringError{"No url in mock downloader."}
 }
 
-func TestInTransit(t *testing.T) {
-	dp := NewDownloadPool()
-	if dp.IsInTransit("http://localhost/1") == true {
-		t.Error("Url 'http://localhost/1' should not be in transit.")
-	}
-
-	dp.Download("http://localhost/1")
-
-	if dp.IsInTransit("http://localhost/1") == false {
-		t.Error("Url 'http://localhost/1' should be in transit.")
-	}
-
-	dp.Finished("http://localhost/1")
-
-	if dp.IsInTransit("http://localhost/1") == true {
-		t.Error("Url 'http://localhost/1' should not be in transit.")
+// waiters returns the number of callers waiting on the download of the url in
+// addition to the caller that started it.
+func waiters(dp *DownloadPool, url string) int {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	call, hasCall := dp.calls[url]
+	if !hasCall {
+		return 0
 	}
-
+	return call.waiters
 }
 
-func TestPoolMany(t *testing.T) {
+func TestDedupe(t *testing.T) {
+	md := new(mockDownloader)
+	md.mu = sync.Mutex{}
+	md.counts = make(map[string]int)
+	md.payloads = make(map[string][]byte)
+	md.payloads["http://localhost:3001/42099b4af021e53fd8fd4e056c2568d7c2e3ffa8"] = []byte("/")
+	md.payloads["http://localhost:3001/ef090dcea7b507772498cd2e67f2b148ae2609f6"] = []byte("/tram")
+	md.payloads["http://localhost:3001/a11f846da74df08c2e93ede56beefdde735ccc05"] = []byte("/tram-chef-cookbook")
+
+	url := "http://localhost:3001/42099b4af021e53fd8fd4e056c2568d7c2e3ffa8"
 	dp := NewDownloadPool()
-	if dp.IsInTransit("http://localhost/1") == true {
-		t.Error("Url 'http://localhost/1' should not be in transit.")
-	}
-	if dp.IsInTransit("http://localhost/2") == true {
-		t.Error("Url 'http://localhost/2' should not be in transit.")
+	started := make(chan bool)
+	release := make(chan bool)
+	download := func() (interface{}, error) {
+		started <- true
+		<-release
+		return md.download(url, FetchOptions{})
 	}
 
-	dp.Download("http://localhost/1")
-	dp.Download("http://localhost/1")
-	dp.Download("http://localhost/2")
+	results := make([]interface{}, 2)
+	shared := make([]bool, 2)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		var err error
+		results[0], err, shared[0] = dp.Do(url, download)
+		if err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	<-started
+	go func() {
+		defer wg.Done()
+		var err error
+		results[1], err, shared[1] = dp.Do(url, download)
+		if err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	for waiters(dp, url) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
 
-	if dp.IsInTransit("http://localhost/1") == false {
-		t.Error("Url 'http://localhost/1' should be in transit.")
+	if md.counts[url] != 1 {
+		t.Error("Url should have been downloaded once but was downloaded", md.counts[url], "times.")
 	}
-	if dp.IsInTransit("http://localhost/2") == false {
-		t.Error("Url 'http://localhost/2' should be in transit.")
+	if results[0] == nil || results[0] != results[1] {
+		t.Error("Both callers should receive the same result.")
 	}
-
-	dp.Finished("http://localhost/1")
-
-	if dp.IsInTransit("http://localhost/1") == true {
-		t.Error("Url 'http://localhost/1' should not be in transit.")
+	if shared[0] || !shared[1] {
+		t.Error("Only the second caller should receive a shared result.")
 	}
-	if dp.IsInTransit("http://localhost/2") == false {
-		t.Error("Url 'http://localhost/2' should be in transit.")
+	if dp.InTransit() != 0 {
+		t.Error("Url should not be in transit.")
 	}
 }
 
-func TestDedupe(t *testing.T) {
+func TestDedupeError(t *testing.T) {
 	md := new(mockDownloader)
 	md.mu = sync.Mutex{}
 	md.counts = make(map[string]int)
 	md.payloads = make(map[string][]byte)
-	md.payloads["http://localhost:3001/42099b4af021e53fd8fd4e056c2568d7c2e3ffa8"] = []byte("/")
-	md.payloads["http://localhost:3001/ef090dcea7b507772498cd2e67f2b148ae2609f6"] = []byte("/tram")
-	md.payloads["http://localhost:3001/a11f846da74df08c2e93ede56beefdde735ccc05"] = []byte("/tram-chef-cookbook")
 
-	downloader := DedupeWrapDownloader(md.download)
+	url := "http://localhost:3001/missing"
+	dp := NewDownloadPool()
+	started := make(chan bool)
+	release := make(chan bool)
+	download := func() (interface{}, error) {
+		started <- true
+		<-release
+		return md.download(url, FetchOptions{})
+	}
 
+	errs := make([]error, 2)
 	var wg sync.WaitGroup
+	wg.Add(2)
 	go func() {
-		wg.Add(1)
-		_, err := downloader("http://localhost:3001/42099b4af021e53fd8fd4e056c2568d7c2e3ffa8")
-		if err != nil {
-			t.Error(err.Error())
-		}
 		defer wg.Done()
+		_, errs[0], _ = dp.Do(url, download)
 	}()
+	<-started
 	go func() {
-		wg.Add(1)
-		_, err := downloader("http://localhost:3001/42099b4af021e53fd8fd4e056c2568d7c2e3ffa8")
-		if err == nil {
-			t.Error(err.Error())
-		}
 		defer wg.Done()
+		_, errs[1], _ = dp.Do(url, download)
 	}()
+	for waiters(dp, url) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
 	wg.Wait()
+
+	if errs[0] == nil || errs[0] != errs[1] {
+		t.Error("Both callers should receive the same error.")
+	}
 }
@@ -0,0 +1,108 @@
+package util
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// DirectProxy is the proxy setting that disables proxies, including those
+// configured by the environment.
+const DirectProxy = "direct"
+
+// newProxyFunc returns the proxy function used by the transport. When no
+// proxy is given, the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+// variables are used. Urls that match any of the noProxy rules, as described
+// by CheckUrl, are fetched directly.
+func newProxyFunc(proxy string, noProxy []string) (func(*http.Request) (*url.URL, error), error) {
+	if proxy == DirectProxy {
+		return nil, nil
+	}
+	if proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	proxyUrl, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		for _, rule := range noProxy {
+			if matchesRule(rule, req.URL) {
+				return nil, nil
+			}
+		}
+		return proxyUrl, nil
+	}, nil
+}
+
+// privateAddressProxyFunc wraps the proxy function so that requests sent
+// through a proxy are refused when the host of the url is, or resolves to, a
+// private address outside of the allowed networks. Only the connection to the
+// proxy is made by the dialer, so its checks never see the host of the url.
+// Hosts that cannot be resolved locally are left to the proxy to resolve,
+// because hosts that can only reach the internet through a proxy often cannot
+// resolve public names themselves.
+func privateAddressProxyFunc(proxyFunc func(*http.Request) (*url.URL, error), allowedNetworks []*net.IPNet) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		proxyUrl, err := proxyFunc(req)
+		if err != nil || proxyUrl == nil {
+			return proxyUrl, err
+		}
+		host := req.URL.Hostname()
+		ips := make([]net.IP, 0, 1)
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			addresses, err := net.DefaultResolver.LookupIPAddr(req.Context(), host)
+			if err != nil {
+				return proxyUrl, nil
+			}
+			for _, address := range addresses {
+				ips = append(ips, address.IP)
+			}
+		}
+		for _, ip := range ips {
+			if !allowedAddress(ip, allowedNetworks) {
+				return nil, &BlockedError{req.URL.Host, "the address " + ip.String() + " is private"}
+			}
+		}
+		return proxyUrl, nil
+	}
+}
+
+// proxyAddresses returns the host and port of the proxies that may be used
+// for the proxy setting. Connections to these addresses are not subject to
+// the private address checks, because proxies are commonly on private
+// networks.
+func proxyAddresses(proxy string) map[string]bool {
+	addresses := make(map[string]bool)
+	proxies := []string{proxy}
+	if proxy == "" {
+		for _, name := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy"} {
+			proxies = append(proxies, os.Getenv(name))
+		}
+	}
+	for _, rawProxy := range proxies {
+		if rawProxy == "" || rawProxy == DirectProxy {
+			continue
+		}
+		if !strings.Contains(rawProxy, "://") {
+			rawProxy = "http://" + rawProxy
+		}
+		proxyUrl, err := url.Parse(rawProxy)
+		if err != nil || proxyUrl.Hostname() == "" {
+			continue
+		}
+		port := proxyUrl.Port()
+		if port == "" {
+			port = urlPort(proxyUrl)
+		}
+		if port == "" && strings.HasPrefix(proxyUrl.Scheme, "socks5") {
+			port = "1080"
+		}
+		addresses[net.JoinHostPort(proxyUrl.Hostname(), port)] = true
+	}
+	return addresses
+}
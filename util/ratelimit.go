@@ -0,0 +1,211 @@
+package util
+
+import (
+	"io"
+	"math"
+	neturl "net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenBucket allows events at a steady rate with bursts of up to one
+// second's worth of events.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates a full token bucket that refills at the rate, in
+// tokens per second.
+func NewTokenBucket(rate float64) *TokenBucket {
+	bucket := new(TokenBucket)
+	bucket.rate = rate
+	bucket.burst = math.Max(1, rate)
+	bucket.tokens = bucket.burst
+	bucket.last = time.Now()
+	return bucket
+}
+
+// Wait blocks until n tokens have been taken from the bucket. Taking more
+// tokens than the burst leaves the bucket in debt, which delays later calls.
+func (bucket *TokenBucket) Wait(n float64) {
+	bucket.mu.Lock()
+	bucket.refill()
+	bucket.tokens -= n
+	var delay time.Duration
+	if bucket.tokens < 0 {
+		delay = time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+	}
+	bucket.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Tokens returns the number of tokens in the bucket, which is negative when
+// callers are waiting.
+func (bucket *TokenBucket) Tokens() float64 {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.refill()
+	return bucket.tokens
+}
+
+func (bucket *TokenBucket) refill() {
+	now := time.Now()
+	bucket.tokens = math.Min(bucket.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+	bucket.last = now
+}
+
+// RateLimiters holds the request and byte rate limits of each host. Origins
+// that share a host but configure different rates have separate limiters.
+type RateLimiters struct {
+	mu       sync.Mutex
+	limiters map[rateLimiterKey]*hostRateLimiter
+}
+
+type rateLimiterKey struct {
+	host              string
+	requestsPerSecond float64
+	bytesPerSecond    int64
+}
+
+type hostRateLimiter struct {
+	requests *TokenBucket
+	bytes    *TokenBucket
+	state    RateLimiterState
+}
+
+// RateLimiterState describes the limits of a host and the requests and bytes
+// that have been fetched from it.
+type RateLimiterState struct {
+	Host              string  `json:"host"`
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	BytesPerSecond    int64   `json:"bytesPerSecond"`
+	RequestTokens     float64 `json:"requestTokens"`
+	ByteTokens        float64 `json:"byteTokens"`
+	Requests          int64   `json:"requests"`
+	Bytes             int64   `json:"bytes"`
+}
+
+func NewRateLimiters() *RateLimiters {
+	rateLimiters := new(RateLimiters)
+	rateLimiters.limiters = make(map[rateLimiterKey]*hostRateLimiter)
+	return rateLimiters
+}
+
+// State returns the state of each limiter that has been used, ordered by
+// host.
+func (rateLimiters *RateLimiters) State() []RateLimiterState {
+	rateLimiters.mu.Lock()
+	defer rateLimiters.mu.Unlock()
+	states := make([]RateLimiterState, 0, len(rateLimiters.limiters))
+	for _, limiter := range rateLimiters.limiters {
+		state := limiter.state
+		if limiter.requests != nil {
+			state.RequestTokens = limiter.requests.Tokens()
+		}
+		if limiter.bytes != nil {
+			state.ByteTokens = limiter.bytes.Tokens()
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Host != states[j].Host {
+			return states[i].Host < states[j].Host
+		}
+		if states[i].RequestsPerSecond != states[j].RequestsPerSecond {
+			return states[i].RequestsPerSecond < states[j].RequestsPerSecond
+		}
+		return states[i].BytesPerSecond < states[j].BytesPerSecond
+	})
+	return states
+}
+
+// limiter returns the limiter for the host and the rates of the options,
+// creating it if it has not been used before. A bucket is nil when there is
+// no limit.
+func (rateLimiters *RateLimiters) limiter(host string, options FetchOptions) *hostRateLimiter {
+	key := rateLimiterKey{host, options.RequestsPerSecond, options.BytesPerSecond}
+	rateLimiters.mu.Lock()
+	defer rateLimiters.mu.Unlock()
+	limiter, hasLimiter := rateLimiters.limiters[key]
+	if !hasLimiter {
+		limiter = new(hostRateLimiter)
+		if options.RequestsPerSecond > 0 {
+			limiter.requests = NewTokenBucket(options.RequestsPerSecond)
+		}
+		if options.BytesPerSecond > 0 {
+			limiter.bytes = NewTokenBucket(float64(options.BytesPerSecond))
+		}
+		limiter.state = RateLimiterState{Host: host, RequestsPerSecond: options.RequestsPerSecond, BytesPerSecond: options.BytesPerSecond}
+		rateLimiters.limiters[key] = limiter
+	}
+	return limiter
+}
+
+func (rateLimiters *RateLimiters) record(limiter *hostRateLimiter, requests, bytes int64) {
+	rateLimiters.mu.Lock()
+	limiter.state.Requests += requests
+	limiter.state.Bytes += bytes
+	rateLimiters.mu.Unlock()
+}
+
+// RateLimitedFetcher wraps the fetcher so that each host is limited to the
+// requests and bytes per second given by the fetch options. A request token
+// is taken before every attempt, including retries made by the fetcher, so
+// the fetcher must call the waitForRequest function of the options as
+// DefaultRemoteFileFetcher does. Hosts without limits are fetched as normal.
+func RateLimitedFetcher(fetcher RemoteFileFetcher, rateLimiters *RateLimiters) RemoteFileFetcher {
+	return func(url string, options FetchOptions) (*RemoteFile, error) {
+		if options.RequestsPerSecond <= 0 && options.BytesPerSecond <= 0 {
+			return fetcher(url, options)
+		}
+		limiter := rateLimiters.limiter(rateLimitHost(url), options)
+		options.waitForRequest = func() {
+			if limiter.requests != nil {
+				limiter.requests.Wait(1)
+			}
+			rateLimiters.record(limiter, 1, 0)
+		}
+
+		remoteFile, err := fetcher(url, options)
+		if err != nil {
+			return nil, err
+		}
+		if limiter.bytes != nil {
+			remoteFile.Body = &rateLimitedReader{remoteFile.Body, limiter.bytes, limiter, rateLimiters}
+		}
+		return remoteFile, nil
+	}
+}
+
+func rateLimitHost(rawUrl string) string {
+	parsedUrl, err := neturl.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsedUrl.Host)
+}
+
+// rateLimitedReader waits for byte tokens for everything that is read.
+type rateLimitedReader struct {
+	io.ReadCloser
+	bytes        *TokenBucket
+	limiter      *hostRateLimiter
+	rateLimiters *RateLimiters
+}
+
+func (reader *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(p)
+	if n > 0 {
+		reader.bytes.Wait(float64(n))
+		reader.rateLimiters.record(reader.limiter, 0, int64(n))
+	}
+	return n, err
+}
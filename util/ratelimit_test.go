@@ -0,0 +1,82 @@
+package util
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bucket := NewTokenBucket(100)
+	start := time.Now()
+	bucket.Wait(100)
+	if time.Since(start) > 50*time.Millisecond {
+		t.Error("A full bucket should not wait.")
+	}
+	bucket.Wait(10)
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Error("An empty bucket should wait but waited", elapsed)
+	}
+}
+
+func TestRateLimitedFetcher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(strings.Repeat("a", 100)))
+	}))
+	defer server.Close()
+
+	rateLimiters := NewRateLimiters()
+	fetcher := RateLimitedFetcher(DefaultRemoteFileFetcher, rateLimiters)
+	for i := 0; i < 2; i++ {
+		remoteFile, err := fetcher(server.URL, FetchOptions{RequestsPerSecond: 10, BytesPerSecond: 1000})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		ioutil.ReadAll(remoteFile.Body)
+		remoteFile.Body.Close()
+	}
+
+	states := rateLimiters.State()
+	if len(states) != 1 || states[0].Host != rateLimitHost(server.URL) {
+		t.Fatal("Expected the state of the host to be recorded but got", states)
+	}
+	if states[0].Requests != 2 || states[0].Bytes != 200 {
+		t.Error("Unexpected state", states[0])
+	}
+
+	// Origins that share the host with other rates have their own limiter.
+	remoteFile, err := fetcher(server.URL, FetchOptions{RequestsPerSecond: 5})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	remoteFile.Body.Close()
+	states = rateLimiters.State()
+	if len(states) != 2 || states[0].RequestsPerSecond != 5 || states[1].RequestsPerSecond != 10 {
+		t.Error("Expected a limiter for each rate but got", states)
+	}
+}
+
+func TestRateLimitedFetcherLimitsRetries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(503)
+	}))
+	defer server.Close()
+
+	rateLimiters := NewRateLimiters()
+	fetcher := RateLimitedFetcher(DefaultRemoteFileFetcher, rateLimiters)
+	start := time.Now()
+	_, err := fetcher(server.URL, FetchOptions{RequestsPerSecond: 2, Retries: 2, RetryBackoff: time.Millisecond})
+	if err == nil {
+		t.Fatal("Expected an error for a 503 response.")
+	}
+	// The burst allows two requests, so the second retry waits half a second.
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Error("Expected each retry to wait for a request token but took", elapsed)
+	}
+	if states := rateLimiters.State(); states[0].Requests != 3 {
+		t.Error("Expected 3 requests to be recorded but got", states[0].Requests)
+	}
+}
@@ -0,0 +1,160 @@
+package util
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	// PriorityInteractive is used for downloads that a client is waiting on.
+	PriorityInteractive = iota
+	// PriorityBulk is used for downloads that are queued to warm the cache.
+	PriorityBulk
+
+	priorityCount
+)
+
+// ErrQueueFull is returned when a job is submitted to a worker pool whose
+// queue is full.
+var ErrQueueFull = errors.New("The worker queue is full")
+
+// Job is a unit of work run by a WorkerPool. Jobs for the same host share
+// the per-host limit, which can be changed for a single job with HostLimit.
+type Job struct {
+	Key       string
+	Host      string
+	HostLimit int
+	Priority  int
+	Run       func()
+}
+
+// WorkerPool runs jobs with a fixed number of workers. Queued jobs are
+// started in priority order, skipping jobs whose host is already running as
+// many jobs as it is allowed.
+type WorkerPool struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	queues    [priorityCount][]*Job
+	queued    int
+	queueSize int
+	perHost   int
+	running   map[string]int
+}
+
+// NewWorkerPool creates a worker pool and starts its workers. A perHost
+// limit of zero means that hosts are not limited.
+func NewWorkerPool(workers, perHost, queueSize int) *WorkerPool {
+	pool := new(WorkerPool)
+	pool.cond = sync.NewCond(&pool.mu)
+	pool.queueSize = queueSize
+	pool.perHost = perHost
+	pool.running = make(map[string]int)
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+	return pool
+}
+
+// Submit queues the job, returning ErrQueueFull if the queue is full.
+func (pool *WorkerPool) Submit(job Job) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.queued >= pool.queueSize {
+		return ErrQueueFull
+	}
+	priority := clampPriority(job.Priority)
+	pool.queues[priority] = append(pool.queues[priority], &job)
+	pool.queued++
+	pool.cond.Broadcast()
+	return nil
+}
+
+// Promote moves the queued job with the key to a higher priority. It returns
+// false if no job with the key is queued at a lower priority.
+func (pool *WorkerPool) Promote(key string, priority int) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	priority = clampPriority(priority)
+	for lower := priority + 1; lower < priorityCount; lower++ {
+		for index, job := range pool.queues[lower] {
+			if job.Key == key {
+				pool.queues[lower] = append(pool.queues[lower][:index], pool.queues[lower][index+1:]...)
+				job.Priority = priority
+				pool.queues[priority] = append(pool.queues[priority], job)
+				pool.cond.Broadcast()
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Queued returns the number of jobs waiting to be run.
+func (pool *WorkerPool) Queued() int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return pool.queued
+}
+
+// Running returns the number of jobs being run.
+func (pool *WorkerPool) Running() int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	running := 0
+	for _, count := range pool.running {
+		running += count
+	}
+	return running
+}
+
+func (pool *WorkerPool) work() {
+	pool.mu.Lock()
+	for {
+		job := pool.next()
+		if job == nil {
+			pool.cond.Wait()
+			continue
+		}
+		pool.running[job.Host]++
+		pool.mu.Unlock()
+
+		job.Run()
+
+		pool.mu.Lock()
+		pool.running[job.Host]--
+		if pool.running[job.Host] == 0 {
+			delete(pool.running, job.Host)
+		}
+		pool.cond.Broadcast()
+	}
+}
+
+// next removes and returns the next job that can be run or nil if there are
+// none. The lock must be held.
+func (pool *WorkerPool) next() *Job {
+	for priority := range pool.queues {
+		for index, job := range pool.queues[priority] {
+			hostLimit := job.HostLimit
+			if hostLimit == 0 {
+				hostLimit = pool.perHost
+			}
+			if hostLimit > 0 && pool.running[job.Host] >= hostLimit {
+				continue
+			}
+			pool.queues[priority] = append(pool.queues[priority][:index], pool.queues[priority][index+1:]...)
+			pool.queued--
+			return job
+		}
+	}
+	return nil
+}
+
+func clampPriority(priority int) int {
+	if priority < 0 {
+		return 0
+	}
+	if priority >= priorityCount {
+		return priorityCount - 1
+	}
+	return priority
+}
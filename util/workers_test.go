@@ -0,0 +1,71 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolQueueFull(t *testing.T) {
+	release := make(chan bool)
+	pool := NewWorkerPool(1, 0, 1)
+	defer close(release)
+
+	started := make(chan bool)
+	pool.Submit(Job{Host: "a", Run: func() { started <- true; <-release }})
+	<-started
+
+	if err := pool.Submit(Job{Host: "a", Run: func() {}}); err != nil {
+		t.Fatal("Expected the job to be queued.", err)
+	}
+	if err := pool.Submit(Job{Host: "a", Run: func() {}}); err != ErrQueueFull {
+		t.Error("Expected ErrQueueFull but got", err)
+	}
+}
+
+func TestWorkerPoolPriority(t *testing.T) {
+	release := make(chan bool)
+	pool := NewWorkerPool(1, 0, 10)
+
+	started := make(chan bool)
+	pool.Submit(Job{Host: "a", Run: func() { started <- true; <-release }})
+	<-started
+
+	order := make(chan string, 3)
+	pool.Submit(Job{Key: "bulk", Host: "a", Priority: PriorityBulk, Run: func() { order <- "bulk" }})
+	pool.Submit(Job{Key: "promoted", Host: "a", Priority: PriorityBulk, Run: func() { order <- "promoted" }})
+	pool.Submit(Job{Key: "interactive", Host: "a", Priority: PriorityInteractive, Run: func() { order <- "interactive" }})
+	if !pool.Promote("promoted", PriorityInteractive) {
+		t.Error("Expected the job to be promoted.")
+	}
+	close(release)
+
+	for _, expected := range []string{"interactive", "promoted", "bulk"} {
+		if actual := <-order; actual != expected {
+			t.Error("Expected", expected, "but got", actual)
+		}
+	}
+}
+
+func TestWorkerPoolPerHost(t *testing.T) {
+	release := make(chan bool)
+	pool := NewWorkerPool(2, 1, 10)
+	defer close(release)
+
+	started := make(chan string, 3)
+	pool.Submit(Job{Host: "a", Run: func() { started <- "a"; <-release }})
+	pool.Submit(Job{Host: "a", Run: func() { started <- "a"; <-release }})
+	pool.Submit(Job{Host: "b", Run: func() { started <- "b"; <-release }})
+
+	seen := map[string]int{}
+	for i := 0; i < 2; i++ {
+		seen[<-started]++
+	}
+	if seen["a"] != 1 || seen["b"] != 1 {
+		t.Error("Expected one job for each host but got", seen)
+	}
+	select {
+	case host := <-started:
+		t.Error("Expected the second job for", host, "to wait.")
+	case <-time.After(50 * time.Millisecond):
+	}
+}